@@ -0,0 +1,57 @@
+// Package format contains the colored output helpers shared by the library
+// and the command line interface.
+package format
+
+import (
+	"fmt"
+
+	"github.com/fatih/color"
+)
+
+const (
+	COIN = 1e8
+)
+
+var (
+	FaintWhite = color.New(color.FgWhite, color.Faint).SprintFunc()
+	HiWhite    = color.New(color.FgHiWhite, color.Bold).SprintFunc()
+	HiWhiteF   = color.New(color.FgHiWhite, color.Bold).SprintfFunc()
+	Cyan       = color.New(color.FgBlue, color.Bold).SprintFunc()
+	Err        = color.New(color.FgHiRed, color.Bold).SprintFunc()
+	ErrF       = color.New(color.FgHiRed, color.Bold).SprintfFunc()
+	Info       = color.New(color.FgHiYellow, color.Bold).SprintFunc()
+	InfoF      = color.New(color.FgHiYellow, color.Bold).SprintfFunc()
+)
+
+func Amt(amt int64) string {
+	btc := amt / COIN
+	ms := amt % COIN / 1e6
+	ts := amt % 1e6 / 1e3
+	s := amt % 1e3
+	if btc > 0 {
+		return fmt.Sprintf("%s.%s,%s,%s", InfoF("%d", btc), InfoF("%02d", ms),
+			InfoF("%03d", ts), InfoF("%03d", s))
+	}
+	if ms > 0 {
+		return fmt.Sprintf("%s,%s,%s", InfoF("%d", ms), InfoF("%03d", ts), InfoF("%03d", s))
+	}
+	if ts > 0 {
+		return fmt.Sprintf("%s,%s", InfoF("%d", ts), InfoF("%03d", s))
+	}
+	if s >= 0 {
+		return InfoF("%d", s)
+	}
+	return Err("error: ", amt)
+}
+
+func Fee(amtMsat int64) string {
+	if amtMsat < 1000 {
+		return HiWhiteF("0.%03d", amtMsat)
+	}
+	return HiWhite(amtMsat / 1000)
+}
+
+func FeePPM(amtMsat int64, feeMsat int64) string {
+
+	return HiWhite(int64(float64(feeMsat) / float64(amtMsat) * 1e6))
+}
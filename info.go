@@ -1,12 +1,12 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"strings"
 
-	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/mattn/go-runewidth"
+	"github.com/rkfg/regolancer/format"
+	"github.com/rkfg/regolancer/rebalancer"
 )
 
 func printBooleanOption(name string, value bool) {
@@ -14,85 +14,132 @@ func printBooleanOption(name string, value bool) {
 	if value {
 		v = "enabled"
 	}
-	fmt.Printf("%s: %s\n", name, hiWhiteColor(v))
+	fmt.Printf("%s: %s\n", name, format.HiWhite(v))
 }
 
-func (r *regolancer) printChannelInfo(ctx context.Context, channel *lnrpc.Channel) error {
-	nodeInfo, err := r.getNodeInfo(ctx, channel.RemotePubkey)
-	if err != nil {
-		return err
-	}
-	alias := runewidth.FillRight(runewidth.Truncate(nodeInfo.Node.Alias, 25, ""), 25)
+func printChannelInfo(channel rebalancer.ChannelInfo) {
+	alias := runewidth.FillRight(runewidth.Truncate(channel.Alias, 25, ""), 25)
 	balance := runewidth.FillRight(strings.Repeat("|", int(channel.LocalBalance*15/channel.Capacity)), 15)
 	balancePct := channel.LocalBalance * 100 / channel.Capacity
-	fmt.Printf("%s [%s] %d%%    ", alias, cyanColor(balance), balancePct)
-	return nil
+	fmt.Printf("%s [%s] %d%%    ", alias, format.Cyan(balance), balancePct)
 }
 
-func (r *regolancer) info(ctx context.Context) error {
+func printCostBasis(costs []rebalancer.ChannelCost) {
+	fmt.Println("Liquidity cost basis")
+	for _, c := range costs {
+		printChannelInfo(c.ChannelInfo)
+		fmt.Printf("%s sat bought at %s ppm\n", format.Amt(c.AmountMsat/1000), format.HiWhite(c.CostPPM))
+	}
+}
+
+func printInfo(info *rebalancer.Info, nodeCacheInfo bool) {
+	opts := info.Options
 	fromIdx := 0
 	toIdx := 0
 	sep := strings.Repeat("—", 98)
-	fmt.Printf("%s\nFrom %s channels %33s To %s channels\n%s\n", sep, hiWhiteColor(len(r.fromChannels)), "", hiWhiteColor(len(r.toChannels)), sep)
+	fmt.Printf("%s\nFrom %s channels %33s To %s channels\n%s\n", sep, format.HiWhite(len(info.From)), "", format.HiWhite(len(info.To)), sep)
 	for {
-		if fromIdx < len(r.fromChannels) {
-			channel := r.fromChannels[fromIdx]
-			err := r.printChannelInfo(ctx, channel)
-			if err != nil {
-				return err
-			}
+		if fromIdx < len(info.From) {
+			printChannelInfo(info.From[fromIdx])
 			fromIdx++
 		} else {
 			fmt.Print(strings.Repeat(" ", 51))
 		}
-		if toIdx < len(r.toChannels) {
-			channel := r.toChannels[toIdx]
-			err := r.printChannelInfo(ctx, channel)
-			if err != nil {
-				return err
-			}
+		if toIdx < len(info.To) {
+			printChannelInfo(info.To[toIdx])
 			toIdx++
 		}
 		fmt.Println()
-		if fromIdx >= len(r.fromChannels) && toIdx >= len(r.toChannels) {
+		if fromIdx >= len(info.From) && toIdx >= len(info.To) {
 			break
 		}
 	}
 	fmt.Println(sep)
-	fmt.Printf("Min amount: %s sat\n", formatAmt(params.MinAmount))
-	if params.Amount > 0 {
-		fmt.Printf("Amount: %s sat\n", formatAmt(params.Amount))
+	if info.CostBasis != nil {
+		printCostBasis(info.CostBasis)
+		fmt.Println(sep)
+	}
+	fmt.Printf("Min amount: %s sat\n", format.Amt(opts.MinAmount))
+	if opts.Amount > 0 {
+		fmt.Printf("Amount: %s sat\n", format.Amt(opts.Amount))
 	} else {
-		if params.RelAmountFrom > 0 {
-			fmt.Printf("Relative amount from: %s%%\n", formatAmt(int64(params.RelAmountFrom*100)))
+		if opts.RelAmountFrom > 0 {
+			fmt.Printf("Relative amount from: %s%%\n", format.Amt(int64(opts.RelAmountFrom*100)))
 		}
-		if params.RelAmountTo > 0 {
-			fmt.Printf("Relative amount to: %s%%\n", formatAmt(int64(params.RelAmountTo*100)))
+		if opts.RelAmountTo > 0 {
+			fmt.Printf("Relative amount to: %s%%\n", format.Amt(int64(opts.RelAmountTo*100)))
 		}
 	}
-	if params.FeeLimitPPM > 0 {
-		fmt.Printf("Max fee: %s ppm", formatAmt(int64(params.FeeLimitPPM)))
-	} else if params.EconRatio > 0 {
-		fmt.Printf("Max fee: %s%% of target channel ppm", formatAmt(int64(params.EconRatio*100)))
-		if params.EconRatioMaxPPM > 0 {
-			fmt.Printf(" (but <= %s ppm)", formatAmt(int64(params.EconRatioMaxPPM)))
+	if opts.TotalAmount > 0 {
+		fmt.Printf("Total amount: %s sat\n", format.Amt(opts.TotalAmount))
+	}
+	if opts.MaxRebalances > 0 {
+		fmt.Printf("Max rebalances: %s\n", format.HiWhite(opts.MaxRebalances))
+	}
+	if opts.FeeLimitPPM > 0 {
+		fmt.Printf("Max fee: %s ppm", format.Amt(int64(opts.FeeLimitPPM)))
+	} else if opts.EconForwardsDays > 0 {
+		fmt.Printf("Max fee: %s%% of target channel realized ppm in the last %s days", format.Amt(int64(opts.EconRatio*100)),
+			format.HiWhite(opts.EconForwardsDays))
+		if opts.EconForwardsMinPPM > 0 {
+			fmt.Printf(" (but >= %s ppm)", format.Amt(opts.EconForwardsMinPPM))
+		}
+		if opts.EconRatioMaxPPM > 0 {
+			fmt.Printf(" (but <= %s ppm)", format.Amt(int64(opts.EconRatioMaxPPM)))
+		}
+		if opts.EconForwardsNoHistoryPPM > 0 {
+			fmt.Printf("\nMax fee for channels without forwards: %s ppm", format.Amt(opts.EconForwardsNoHistoryPPM))
+		} else {
+			fmt.Print("\nChannels without forwards are not used as targets")
+		}
+	} else if opts.EconRatio > 0 {
+		fmt.Printf("Max fee: %s%% of target channel ppm", format.Amt(int64(opts.EconRatio*100)))
+		if opts.EconRatioMaxPPM > 0 {
+			fmt.Printf(" (but <= %s ppm)", format.Amt(int64(opts.EconRatioMaxPPM)))
 		}
 	}
 	fmt.Println()
-	if params.ExcludeChannelAge != 0 {
-		fmt.Printf("Channel age needs to be >= %s blocks\n", hiWhiteColor(params.ExcludeChannelAge))
+	if opts.ExcludeChannelAge != 0 {
+		fmt.Printf("Channel age needs to be >= %s blocks\n", format.HiWhite(opts.ExcludeChannelAge))
+	}
+	fmt.Printf("Fail tolerance: %s ppm\n", format.Amt(int64(opts.FailTolerance)))
+	printBooleanOption("Target first routing", opts.TargetFirst)
+	printBooleanOption("Rapid rebalance", opts.AllowRapidRebalance)
+	if opts.AllowRapidRebalance {
+		fmt.Printf("Rapid rebalance strategy: %s\n", format.HiWhite(opts.RapidStrategy))
+	}
+	if info.Goal != nil {
+		action := "drain"
+		if info.Goal.Refill {
+			action = "refill"
+		}
+		fmt.Printf("Goal: %s channel %s to %s%% local balance\n", action, format.HiWhite(info.Goal.ChanId), format.HiWhite(int64(info.Goal.Ratio*100)))
+		if info.Goal.FeeBudgetMsat > 0 {
+			fmt.Printf("Goal fee budget: %s sat\n", format.Amt(info.Goal.FeeBudgetMsat/1000))
+		}
+	}
+	printBooleanOption("Lost profit accounting", opts.LostProfit)
+	if opts.FeeGuard {
+		fmt.Printf("Fee guard: rebalance ppm <= target channel fee rate - %s ppm\n", format.Amt(opts.FeeGuardMargin))
+	}
+	printBooleanOption("Loop out fallback", opts.LoopOutFallback)
+	if opts.LoopOutFallback {
+		fmt.Printf("Max loop out cost: %s ppm\n", format.Amt(opts.LoopOutMaxPPM))
+	}
+	if opts.ProbeSteps > 0 {
+		fmt.Printf("Probing steps: %s\n", format.HiWhite(opts.ProbeSteps))
+		if opts.ProbeParallel > 1 {
+			fmt.Printf("Parallel probes: %s\n", format.HiWhite(opts.ProbeParallel))
+		}
 	}
-	fmt.Printf("Fail tolerance: %s ppm\n", formatAmt(int64(params.FailTolerance)))
-	printBooleanOption("Rapid rebalance", params.AllowRapidRebalance)
-	printBooleanOption("Lost profit accounting", params.LostProfit)
-	if params.ProbeSteps > 0 {
-		fmt.Printf("Probing steps: %s\n", hiWhiteColor(params.ProbeSteps))
+	fmt.Printf("Node cache size: %s records, life time: %s days %s hours %s minutes\n", format.HiWhite(info.NodeCacheSize), format.HiWhite(opts.NodeCacheLifetime/1440), format.HiWhite(opts.NodeCacheLifetime%1440/60), format.HiWhite(opts.NodeCacheLifetime%60))
+	printBooleanOption("Show node cache hits", nodeCacheInfo)
+	if opts.ChanCacheFilename != "" {
+		fmt.Printf("Channel cache life time: %s days %s hours %s minutes\n", format.HiWhite(opts.ChanCacheLifetime/1440),
+			format.HiWhite(opts.ChanCacheLifetime%1440/60), format.HiWhite(opts.ChanCacheLifetime%60))
 	}
-	fmt.Printf("Node cache size: %s records, life time: %s days %s hours %s minutes\n", hiWhiteColor(len(r.nodeCache)), hiWhiteColor(params.NodeCacheLifetime/1440), hiWhiteColor(params.NodeCacheLifetime%1440/60), hiWhiteColor(params.NodeCacheLifetime%60))
-	printBooleanOption("Show node cache hits", params.NodeCacheInfo)
-	fmt.Printf("Total rebalance timeout: %s hours %s minutes\n", hiWhiteColor(params.TimeoutRebalance/60), hiWhiteColor(params.TimeoutRebalance%60))
-	fmt.Printf("Single attempt timeout: %s minutes\n", hiWhiteColor(params.TimeoutAttempt))
-	fmt.Printf("Info query timeout: %s seconds\n", hiWhiteColor(params.TimeoutInfo))
-	fmt.Printf("Route query timeout: %s seconds\n", hiWhiteColor(params.TimeoutRoute))
-	return nil
+	fmt.Printf("Total rebalance timeout: %s hours %s minutes\n", format.HiWhite(opts.TimeoutRebalance/60), format.HiWhite(opts.TimeoutRebalance%60))
+	fmt.Printf("Single attempt timeout: %s minutes\n", format.HiWhite(opts.TimeoutAttempt))
+	fmt.Printf("Info query timeout: %s seconds\n", format.HiWhite(opts.TimeoutInfo))
+	fmt.Printf("Route query timeout: %s seconds\n", format.HiWhite(opts.TimeoutRoute))
 }
@@ -6,11 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
 	"os"
 	"os/signal"
 	"reflect"
-	"strconv"
 	"strings"
 	"time"
 
@@ -19,92 +17,91 @@ import (
 	"github.com/lightninglabs/lndclient"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/walletrpc"
+	"github.com/rkfg/regolancer/format"
 	"github.com/rkfg/regolancer/helpmessage"
+	"github.com/rkfg/regolancer/rebalancer"
+	"github.com/rkfg/regolancer/recorder"
+	"github.com/rkfg/regolancer/simulator"
+	"google.golang.org/grpc"
 )
 
 type configParams struct {
-	Config              string   `rego-grouping:"Config" short:"f" long:"config" description:"config file path"`
-	Connect             string   `rego-grouping:"Node Connection" short:"c" long:"connect" description:"connect to lnd using host:port" json:"connect" toml:"connect"`
-	TLSCert             string   `short:"t" long:"tlscert" description:"path to tls.cert to connect" required:"false" json:"tlscert" toml:"tlscert"`
-	MacaroonDir         string   `long:"macaroon-dir" description:"path to the macaroon directory" required:"false" json:"macaroon_dir" toml:"macaroon_dir"`
-	MacaroonFilename    string   `long:"macaroon-filename" description:"macaroon filename" json:"macaroon_filename" toml:"macaroon_filename"`
-	Network             string   `short:"n" long:"network" description:"bitcoin network to use" json:"network" toml:"network"`
-	FromPerc            int64    `rego-grouping:"Common" long:"pfrom" description:"channels with less than this inbound liquidity percentage will be considered as source channels" json:"pfrom" toml:"pfrom"`
-	ToPerc              int64    `long:"pto" description:"channels with less than this outbound liquidity percentage will be considered as target channels" json:"pto" toml:"pto"`
-	Perc                int64    `short:"p" long:"perc" description:"use this value as both pfrom and pto from above" json:"perc" toml:"perc"`
-	Amount              int64    `short:"a" long:"amount" description:"amount to rebalance" json:"amount" toml:"amount"`
-	RelAmountTo         float64  `long:"rel-amount-to" description:"calculate amount as the target channel capacity fraction (for example, 0.2 means you want to achieve at most 20% target channel local balance)" json:"rel_amount_to" toml:"rel_amount_to"`
-	RelAmountFrom       float64  `long:"rel-amount-from" description:"calculate amount as the source channel capacity fraction (for example, 0.2 means you want to achieve at most 20% source channel remote balance)" json:"rel_amount_from" toml:"rel_amount_from"`
-	ProbeSteps          int      `short:"b" long:"probe-steps" description:"if the payment fails at the last hop try to probe lower amount using this many steps" json:"probe_steps" toml:"probe_steps"`
-	AllowRapidRebalance bool     `long:"allow-rapid-rebalance" description:"if a rebalance succeeds the route will be used for further rebalances until criteria for channels is not satifsied" json:"allow_rapid_rebalance" toml:"allow_rapid_rebalance"`
-	MinAmount           int64    `long:"min-amount" description:"if probing is enabled this will be the minimum amount to try" json:"min_amount" toml:"min_amount"`
-	ExcludeChannelsIn   []string `short:"i" long:"exclude-channel-in" description:"(DEPRECATED) don't use this channel as incoming (can be specified multiple times)" json:"exclude_channels_in" toml:"exclude_channels_in"`
-	ExcludeChannelsOut  []string `short:"o" long:"exclude-channel-out" description:"(DEPRECATED) don't use this channel as outgoing (can be specified multiple times)" json:"exclude_channels_out" toml:"exclude_channels_out"`
-	ExcludeFrom         []string `long:"exclude-from" description:"don't use this node or channel as source (can be specified multiple times)" json:"exclude_from" toml:"exclude_from"`
-	ExcludeTo           []string `long:"exclude-to" description:"don't use this node or channel as target (can be specified multiple times)" json:"exclude_to" toml:"exclude_to"`
-	ExcludeChannels     []string `short:"e" long:"exclude-channel" description:"(DEPRECATED) don't use this channel at all (can be specified multiple times)" json:"exclude_channels" toml:"exclude_channels"`
-	ExcludeNodes        []string `short:"d" long:"exclude-node" description:"(DEPRECATED) don't use this node for routing (can be specified multiple times)" json:"exclude_nodes" toml:"exclude_nodes"`
-	Exclude             []string `long:"exclude" description:"don't use this node or your channel for routing (can be specified multiple times)" json:"exclude" toml:"exclude"`
-	ExcludeChannelAge   uint64   `long:"exclude-channel-age" description:"don't use channels opened less than this number of blocks ago" json:"exclude_channel_age" toml:"exclude_channel_age"`
-	To                  []string `long:"to" description:"try only this channel or node as target (should satisfy other constraints too; can be specified multiple times)" json:"to" toml:"to"`
-	From                []string `long:"from" description:"try only this channel or node as source (should satisfy other constraints too; can be specified multiple times)" json:"from" toml:"from"`
-	FailTolerance       int64    `long:"fail-tolerance" description:"a payment that differs from the prior attempt by this ppm will be cancelled" json:"fail_tolerance" toml:"fail_tolerance"`
-	AllowUnbalanceFrom  bool     `long:"allow-unbalance-from" description:"(DEPRECATED) let the source channel go below 50% local liquidity, use if you want to drain a channel; you should also set --pfrom to >50" json:"allow_unbalance_from" toml:"allow_unbalance_from"`
-	AllowUnbalanceTo    bool     `long:"allow-unbalance-to" description:"(DEPRECATED) let the target channel go above 50% local liquidity, use if you want to refill a channel; you should also set --pto to >50" json:"allow_unbalance_to" toml:"allow_unbalance_to"`
-	EconRatio           float64  `short:"r" long:"econ-ratio" description:"economical ratio for fee limit calculation as a multiple of target channel fee (for example, 0.5 means you want to pay at max half the fee you might earn for routing out of the target channel)" json:"econ_ratio" toml:"econ_ratio"`
-	EconRatioMaxPPM     int64    `long:"econ-ratio-max-ppm" description:"limits the max fee ppm for a rebalance when using econ ratio" json:"econ_ratio_max_ppm" toml:"econ_ratio_max_ppm"`
-	FeeLimitPPM         int64    `short:"F" long:"fee-limit-ppm" description:"don't consider the target channel fee and use this max fee ppm instead (can rebalance at a loss, be careful)" json:"fee_limit_ppm" toml:"fee_limit_ppm"`
-	LostProfit          bool     `short:"l" long:"lost-profit" description:"also consider the source channel fee when looking for profitable routes so that route_fee < target_fee * econ_ratio - source_fee" json:"lost_profit" toml:"lost_profit"`
-	NodeCacheFilename   string   `rego-grouping:"Node Cache" long:"node-cache-filename" description:"save and load other nodes information to this file, improves cold start performance"  json:"node_cache_filename" toml:"node_cache_filename"`
-	NodeCacheLifetime   int      `long:"node-cache-lifetime" description:"nodes with last update older than this time (in minutes) will be removed from cache after loading it" json:"node_cache_lifetime" toml:"node_cache_lifetime"`
-	NodeCacheInfo       bool     `long:"node-cache-info" description:"show red and cyan 'x' characters in routes to indicate node cache misses and hits respectively" json:"node_cache_info" toml:"node_cache_info"`
-	TimeoutRebalance    int      `rego-grouping:"Timeouts" long:"timeout-rebalance" description:"max rebalance session time in minutes" json:"timeout_rebalance" toml:"timeout_rebalance"`
-	TimeoutAttempt      int      `long:"timeout-attempt" description:"max attempt time in minutes" json:"timeout_attempt" toml:"timeout_attempt"`
-	TimeoutInfo         int      `long:"timeout-info" description:"max general info query time (local channels, node id etc.) in seconds" json:"timeout_info" toml:"timeout_info"`
-	TimeoutRoute        int      `long:"timeout-route" description:"max channel selection and route query time in seconds" json:"timeout_route" toml:"timeout_route"`
-	StatFilename        string   `rego-grouping:"Others" short:"s" long:"stat" description:"save successful rebalance information to the specified CSV file" json:"stat" toml:"stat"`
-	Version             bool     `short:"v" long:"version" description:"show program version and exit"`
-	Info                bool     `long:"info" description:"show rebalance information"`
-	Help                bool     `short:"h" long:"help" description:"Show this help message"`
+	Config                   string   `rego-grouping:"Config" short:"f" long:"config" description:"config file path"`
+	Connect                  string   `rego-grouping:"Node Connection" short:"c" long:"connect" description:"connect to lnd using host:port" json:"connect" toml:"connect"`
+	TLSCert                  string   `short:"t" long:"tlscert" description:"path to tls.cert to connect" required:"false" json:"tlscert" toml:"tlscert"`
+	MacaroonDir              string   `long:"macaroon-dir" description:"path to the macaroon directory" required:"false" json:"macaroon_dir" toml:"macaroon_dir"`
+	MacaroonFilename         string   `long:"macaroon-filename" description:"macaroon filename" json:"macaroon_filename" toml:"macaroon_filename"`
+	Network                  string   `short:"n" long:"network" description:"bitcoin network to use" json:"network" toml:"network"`
+	FromPerc                 int64    `rego-grouping:"Common" long:"pfrom" description:"channels with less than this inbound liquidity percentage will be considered as source channels" json:"pfrom" toml:"pfrom"`
+	ToPerc                   int64    `long:"pto" description:"channels with less than this outbound liquidity percentage will be considered as target channels" json:"pto" toml:"pto"`
+	Perc                     int64    `short:"p" long:"perc" description:"use this value as both pfrom and pto from above" json:"perc" toml:"perc"`
+	Amount                   int64    `short:"a" long:"amount" description:"amount to rebalance" json:"amount" toml:"amount"`
+	RelAmountTo              float64  `long:"rel-amount-to" description:"calculate amount as the target channel capacity fraction (for example, 0.2 means you want to achieve at most 20% target channel local balance)" json:"rel_amount_to" toml:"rel_amount_to"`
+	RelAmountFrom            float64  `long:"rel-amount-from" description:"calculate amount as the source channel capacity fraction (for example, 0.2 means you want to achieve at most 20% source channel remote balance)" json:"rel_amount_from" toml:"rel_amount_from"`
+	ProbeSteps               int      `short:"b" long:"probe-steps" description:"if the payment fails at any hop try to probe lower amount using this many steps" json:"probe_steps" toml:"probe_steps"`
+	ProbeParallel            int      `long:"probe-parallel" description:"send up to this many probes at different amounts at once on every probing step, limited by the free HTLC slots of the source channel" json:"probe_parallel" toml:"probe_parallel"`
+	TargetFirst              bool     `long:"target-first" description:"pick the target channel first and let lnd choose the best source channel for it among all candidates, failed sources are skipped and the route is queried again" json:"target_first" toml:"target_first"`
+	AllowRapidRebalance      bool     `long:"allow-rapid-rebalance" description:"if a rebalance succeeds the route will be used for further rebalances until criteria for channels is not satifsied" json:"allow_rapid_rebalance" toml:"allow_rapid_rebalance"`
+	RapidStrategy            string   `long:"rapid-strategy" description:"how to change the rapid rebalance amount: double (double it while it succeeds, then halve it), step (add the initial amount while it succeeds, then subtract it), ladder (grow it 1.5 times up to the route max HTLC, then step down) or repeat (repeat the same amount until it fails)" json:"rapid_strategy" toml:"rapid_strategy"`
+	MinAmount                int64    `long:"min-amount" description:"if probing is enabled this will be the minimum amount to try" json:"min_amount" toml:"min_amount"`
+	ExcludeChannelsIn        []string `short:"i" long:"exclude-channel-in" description:"(DEPRECATED) don't use this channel as incoming (can be specified multiple times)" json:"exclude_channels_in" toml:"exclude_channels_in"`
+	ExcludeChannelsOut       []string `short:"o" long:"exclude-channel-out" description:"(DEPRECATED) don't use this channel as outgoing (can be specified multiple times)" json:"exclude_channels_out" toml:"exclude_channels_out"`
+	ExcludeFrom              []string `long:"exclude-from" description:"don't use this node or channel as source (can be specified multiple times)" json:"exclude_from" toml:"exclude_from"`
+	ExcludeTo                []string `long:"exclude-to" description:"don't use this node or channel as target (can be specified multiple times)" json:"exclude_to" toml:"exclude_to"`
+	ExcludeChannels          []string `short:"e" long:"exclude-channel" description:"(DEPRECATED) don't use this channel at all (can be specified multiple times)" json:"exclude_channels" toml:"exclude_channels"`
+	ExcludeNodes             []string `short:"d" long:"exclude-node" description:"(DEPRECATED) don't use this node for routing (can be specified multiple times)" json:"exclude_nodes" toml:"exclude_nodes"`
+	Exclude                  []string `long:"exclude" description:"don't use this node or your channel for routing (can be specified multiple times)" json:"exclude" toml:"exclude"`
+	ExcludeChannelAge        uint64   `long:"exclude-channel-age" description:"don't use channels opened less than this number of blocks ago" json:"exclude_channel_age" toml:"exclude_channel_age"`
+	To                       []string `long:"to" description:"try only this channel or node as target (should satisfy other constraints too; can be specified multiple times)" json:"to" toml:"to"`
+	From                     []string `long:"from" description:"try only this channel or node as source (should satisfy other constraints too; can be specified multiple times)" json:"from" toml:"from"`
+	FailTolerance            int64    `long:"fail-tolerance" description:"a payment that differs from the prior attempt by this ppm will be cancelled" json:"fail_tolerance" toml:"fail_tolerance"`
+	AllowUnbalanceFrom       bool     `long:"allow-unbalance-from" description:"(DEPRECATED) let the source channel go below 50% local liquidity, use if you want to drain a channel; you should also set --pfrom to >50" json:"allow_unbalance_from" toml:"allow_unbalance_from"`
+	AllowUnbalanceTo         bool     `long:"allow-unbalance-to" description:"(DEPRECATED) let the target channel go above 50% local liquidity, use if you want to refill a channel; you should also set --pto to >50" json:"allow_unbalance_to" toml:"allow_unbalance_to"`
+	EconRatio                float64  `short:"r" long:"econ-ratio" description:"economical ratio for fee limit calculation as a multiple of target channel fee (for example, 0.5 means you want to pay at max half the fee you might earn for routing out of the target channel)" json:"econ_ratio" toml:"econ_ratio"`
+	EconRatioMaxPPM          int64    `long:"econ-ratio-max-ppm" description:"limits the max fee ppm for a rebalance when using econ ratio" json:"econ_ratio_max_ppm" toml:"econ_ratio_max_ppm"`
+	EconForwardsDays         int      `long:"econ-forwards-days" description:"use the actual earnings of the target channel from forwards in this many last days instead of its advertised fee to calculate the fee limit (econ ratio and econ ratio max ppm are applied to the realized ppm)" json:"econ_forwards_days" toml:"econ_forwards_days"`
+	EconForwardsMinPPM       int64    `long:"econ-forwards-min-ppm" description:"the fee limit calculated from forwards is never lower than this ppm" json:"econ_forwards_min_ppm" toml:"econ_forwards_min_ppm"`
+	EconForwardsMinVolume    int64    `long:"econ-forwards-min-volume" description:"target channels that forwarded less than this amount of sats are considered to have never forwarded anything" json:"econ_forwards_min_volume" toml:"econ_forwards_min_volume"`
+	EconForwardsNoHistoryPPM int64    `long:"econ-forwards-no-history-ppm" description:"max fee ppm for target channels that have never forwarded anything, such channels are not used as targets if not set" json:"econ_forwards_no_history_ppm" toml:"econ_forwards_no_history_ppm"`
+	FeeLimitPPM              int64    `short:"F" long:"fee-limit-ppm" description:"don't consider the target channel fee and use this max fee ppm instead (can rebalance at a loss, be careful)" json:"fee_limit_ppm" toml:"fee_limit_ppm"`
+	LostProfit               bool     `short:"l" long:"lost-profit" description:"also consider the source channel fee when looking for profitable routes so that route_fee < target_fee * econ_ratio - source_fee" json:"lost_profit" toml:"lost_profit"`
+	Goal                     string   `rego-grouping:"Goal" long:"goal" description:"keep rebalancing this channel from different counterpart channels until its local balance reaches the percentage, for example 123456789=60% (the channel is refilled or drained depending on its current balance)" json:"goal" toml:"goal"`
+	GoalFeeBudget            int64    `long:"goal-fee-budget" description:"max total fee in sats to spend in goal mode, the session ends when it's exhausted" json:"goal_fee_budget" toml:"goal_fee_budget"`
+	TotalAmount              int64    `rego-grouping:"Session" long:"total-amount" description:"keep rebalancing different channel pairs until this many sats are moved in total, every rebalance is limited by --amount or the relative amounts" json:"total_amount" toml:"total_amount"`
+	MaxRebalances            int      `long:"max-rebalances" description:"keep rebalancing different channel pairs until this many rebalances succeed (rapid rebalances following a rebalance don't count)" json:"max_rebalances" toml:"max_rebalances"`
+	DrainThreshold           float64  `rego-grouping:"Drain" long:"drain-threshold" description:"drain command rebalances the channel until its local balance is below this percentage (5 by default)" json:"drain_threshold" toml:"drain_threshold"`
+	DrainClose               bool     `long:"drain-close" description:"cooperatively close the channel after it's drained" json:"drain_close" toml:"drain_close"`
+	DrainCloseFeeRate        uint64   `long:"drain-close-fee-rate" description:"fee rate in sat/vbyte for the closing transaction, lnd picks it if not set" json:"drain_close_fee_rate" toml:"drain_close_fee_rate"`
+	LoopOutFallback          bool     `rego-grouping:"Swap" long:"loop-out-fallback" description:"do a Loop Out from the source channel if no circular rebalance succeeded and the swap is cheaper than the routes found" json:"loop_out_fallback" toml:"loop_out_fallback"`
+	LoopOutMaxPPM            int64    `long:"loop-out-max-ppm" description:"max total swap cost in ppm including swap, miner and routing fees" json:"loop_out_max_ppm" toml:"loop_out_max_ppm"`
+	LoopAddress              string   `long:"loop-address" description:"connect to loopd REST API using host:port" json:"loop_address" toml:"loop_address"`
+	LoopTLSCert              string   `long:"loop-tlscert" description:"path to loopd tls.cert" json:"loop_tlscert" toml:"loop_tlscert"`
+	LoopMacaroon             string   `long:"loop-macaroon" description:"path to loopd macaroon" json:"loop_macaroon" toml:"loop_macaroon"`
+	AdviseConfTarget         int32    `rego-grouping:"Advise" long:"advise-conf-target" description:"confirmation target in blocks to estimate the on-chain fee rate for the advise command (6 by default)" json:"advise_conf_target" toml:"advise_conf_target"`
+	CostBasisFilename        string   `rego-grouping:"Cost Basis" long:"cost-basis-filename" description:"track the cost of liquidity bought by rebalancing using the stat file and forwards and save it to this file, the weighted cost is shown in --info" json:"cost_basis_filename" toml:"cost_basis_filename"`
+	FeeGuard                 bool     `long:"fee-guard" description:"refuse rebalances with ppm above the current target channel fee rate minus the margin" json:"fee_guard" toml:"fee_guard"`
+	FeeGuardMargin           int64    `long:"fee-guard-margin" description:"margin in ppm for the fee guard" json:"fee_guard_margin" toml:"fee_guard_margin"`
+	NodeCacheFilename        string   `rego-grouping:"Node Cache" long:"node-cache-filename" description:"save and load other nodes information to this file, improves cold start performance"  json:"node_cache_filename" toml:"node_cache_filename"`
+	NodeCacheLifetime        int      `long:"node-cache-lifetime" description:"nodes with last update older than this time (in minutes) will be removed from cache after loading it" json:"node_cache_lifetime" toml:"node_cache_lifetime"`
+	NodeCacheInfo            bool     `long:"node-cache-info" description:"show red and cyan 'x' characters in routes to indicate node cache misses and hits respectively" json:"node_cache_info" toml:"node_cache_info"`
+	ChanCacheFilename        string   `long:"chan-cache-filename" description:"save and load channel edges with fee policies to this file, improves cold start performance" json:"chan_cache_filename" toml:"chan_cache_filename"`
+	ChanCacheLifetime        int      `long:"chan-cache-lifetime" description:"max time (in minutes) to use a cached channel edge, edges with recently updated policies expire sooner" json:"chan_cache_lifetime" toml:"chan_cache_lifetime"`
+	TimeoutRebalance         int      `rego-grouping:"Timeouts" long:"timeout-rebalance" description:"max rebalance session time in minutes" json:"timeout_rebalance" toml:"timeout_rebalance"`
+	TimeoutAttempt           int      `long:"timeout-attempt" description:"max attempt time in minutes" json:"timeout_attempt" toml:"timeout_attempt"`
+	TimeoutInfo              int      `long:"timeout-info" description:"max general info query time (local channels, node id etc.) in seconds" json:"timeout_info" toml:"timeout_info"`
+	TimeoutRoute             int      `long:"timeout-route" description:"max channel selection and route query time in seconds" json:"timeout_route" toml:"timeout_route"`
+	StatFilename             string   `rego-grouping:"Others" short:"s" long:"stat" description:"save successful rebalance information to the specified CSV file" json:"stat" toml:"stat"`
+	Record                   string   `long:"record" description:"record all lnd calls to this file to reproduce the session later with --replay"`
+	Replay                   string   `long:"replay" description:"don't connect to lnd, replay the lnd calls recorded with --record instead"`
+	Simulate                 string   `long:"simulate" description:"don't connect to lnd, rebalance in the simulated network loaded from this JSON file instead (see README for the format)"`
+	Version                  bool     `short:"v" long:"version" description:"show program version and exit"`
+	Info                     bool     `long:"info" description:"show rebalance information"`
+	Help                     bool     `short:"h" long:"help" description:"Show this help message"`
 }
 
 var params, cfgParams configParams
 
-type failedRoute struct {
-	channelPair [2]*lnrpc.Channel
-	expiration  *time.Time
-}
-
-type cachedNodeInfo struct {
-	*lnrpc.NodeInfo
-	Timestamp time.Time
-}
-
-type regolancer struct {
-	lnClient      lnrpc.LightningClient
-	routerClient  routerrpc.RouterClient
-	myPK          string
-	blockHeight   uint32
-	channels      []*lnrpc.Channel
-	fromChannels  []*lnrpc.Channel
-	fromChannelId map[uint64]struct{}
-	toChannels    []*lnrpc.Channel
-	toChannelId   map[uint64]struct{}
-	channelPairs  map[string][2]*lnrpc.Channel
-	nodeCache     map[string]cachedNodeInfo
-	chanCache     map[uint64]*lnrpc.ChannelEdge
-	failureCache  map[string]failedRoute
-	excludeTo     map[uint64]struct{}
-	excludeFrom   map[uint64]struct{}
-	excludeBoth   map[uint64]struct{}
-	excludeNodes  [][]byte
-	statFilename  string
-	routeFound    bool
-	invoiceCache  map[int64]*lnrpc.AddInvoiceResponse
-	mcCache       map[string]int64
-	failedPairs   []*lnrpc.NodePair
-}
-
 func loadConfig() {
 	_, err := flags.NewParser(&cfgParams, flags.None).Parse()
 	if err != nil {
@@ -119,7 +116,7 @@ func loadConfig() {
 
 		if err != nil {
 			if strings.Contains(err.Error(), "TOML value of type int64 into a Go string") {
-				log.Print(infoColor("Info: all prior int channel arrays are now string arrays. " +
+				log.Print(format.Info("Info: all prior int channel arrays are now string arrays. " +
 					"Make sure the following arguments in the config files are now strings:\n" +
 					"ExcludeChannelsIn,ExcludeChannelsOut, ExcludeChannels,ToChannel, FromChannel"))
 			}
@@ -137,7 +134,7 @@ func loadConfig() {
 			err := decoder.Decode(&params)
 			if err != nil {
 				if strings.Contains(err.Error(), "cannot unmarshal number into Go struct field") {
-					log.Print(infoColor("Info: all prior int channel arrays are now string arrays. " +
+					log.Print(format.Info("Info: all prior int channel arrays are now string arrays. " +
 						"Make sure the following arguments in the config files are now strings:\n" +
 						"ExcludeChannelsIn,ExcludeChannelsOut, ExcludeChannels,ToChannel, FromChannel"))
 				}
@@ -147,32 +144,36 @@ func loadConfig() {
 	}
 }
 
-func convertChanStringToInt(chanIds []string) (channels []uint64) {
-
-	for _, cid := range chanIds {
-
-		chanId, err := strconv.ParseInt(cid, 10, 64)
-
-		if err != nil {
-
-			isScid := strings.Count(strings.ToLower(cid), "x") == 2
-			if isScid {
-				chanId = parseScid(cid)
-
-			} else {
-				log.Fatalf("error: parsing Channel with Id %s, %s ", cid, err)
-
-			}
-		}
-		channels = append(channels, uint64(chanId))
+const (
+	commandDrain  = "drain"
+	commandAdvise = "advise"
+	commandROI    = "roi"
+	commandProbe  = "probe"
+	commandCache  = "cache"
+)
 
+// importGraph fills the caches from the graph file or from lnd if the filename
+// is empty, returns the exit code
+func importGraph(ctx context.Context, r *rebalancer.Rebalancer, filename string) int {
+	nodes, edges, err := r.ImportGraph(ctx, filename)
+	if err != nil {
+		logErrorF("Error importing graph: %s", err)
+		return 1
 	}
+	log.Printf("Imported %s nodes and %s channels", format.HiWhite(nodes), format.HiWhite(edges))
+	return 0
+}
 
-	return channels
-
+func saveCostBasis(r *rebalancer.Rebalancer) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(params.TimeoutInfo))
+	defer cancel()
+	err := r.SaveCostBasis(ctx)
+	if err != nil {
+		logErrorF("Error saving cost basis: %s", err)
+	}
 }
 
-func preflightChecks(params *configParams) error {
+func preflightChecks(params *configParams, args []string) error {
 	if params.Version {
 		printVersion()
 		os.Exit(1)
@@ -198,6 +199,13 @@ func preflightChecks(params *configParams) error {
 	if params.EconRatioMaxPPM != 0 && params.FeeLimitPPM != 0 {
 		return fmt.Errorf("use either econ-ratio-max-ppm or fee-limit-ppm but not both")
 	}
+	if params.EconForwardsDays > 0 && params.FeeLimitPPM != 0 {
+		return fmt.Errorf("use either econ-forwards-days or fee-limit-ppm but not both")
+	}
+	if params.EconForwardsDays == 0 && (params.EconForwardsMinPPM != 0 || params.EconForwardsMinVolume != 0 ||
+		params.EconForwardsNoHistoryPPM != 0) {
+		return fmt.Errorf("econ-forwards-* parameters can only be used with econ-forwards-days")
+	}
 	if params.Perc > 0 {
 		params.FromPerc = params.Perc
 		params.ToPerc = params.Perc
@@ -210,36 +218,128 @@ func preflightChecks(params *configParams) error {
 		(params.RelAmountFrom > 0 || params.RelAmountTo > 0) {
 		return fmt.Errorf("use either precise amount or relative amounts but not both")
 	}
-	if params.Amount == 0 && params.RelAmountFrom == 0 && params.RelAmountTo == 0 {
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "":
+	case commandDrain:
+		if len(args) != 2 {
+			return fmt.Errorf("usage: regolancer [OPTIONS] drain CHANNEL")
+		}
+		if params.Goal != "" {
+			return fmt.Errorf("drain command can't be used with --goal")
+		}
+		if params.DrainThreshold == 0 {
+			params.DrainThreshold = 5
+		}
+		if params.DrainThreshold < 0 || params.DrainThreshold >= 100 {
+			return fmt.Errorf("drain threshold should be between 0 and 100")
+		}
+	case commandAdvise:
+		if params.Amount == 0 {
+			return fmt.Errorf("advise command requires --amount")
+		}
+		if params.AdviseConfTarget == 0 {
+			params.AdviseConfTarget = 6
+		}
+	case commandROI:
+		if params.StatFilename == "" {
+			return fmt.Errorf("roi command requires the stat file (--stat)")
+		}
+	case commandCache:
+		if len(args) < 2 || len(args) > 3 || args[1] != "import" {
+			return fmt.Errorf("usage: regolancer [OPTIONS] cache import [DESCRIBEGRAPH_JSON]")
+		}
+		if params.NodeCacheFilename == "" && params.ChanCacheFilename == "" {
+			return fmt.Errorf("cache import requires --node-cache-filename or --chan-cache-filename")
+		}
+	case commandProbe:
+		if len(args) < 2 {
+			return fmt.Errorf("usage: regolancer [OPTIONS] probe FROM_CHANNEL TO_CHANNEL | [CHANNEL] NODE...")
+		}
+		if params.Amount == 0 {
+			return fmt.Errorf("probe command requires --amount")
+		}
+		if params.ProbeSteps == 0 {
+			params.ProbeSteps = 5
+		}
+	default:
+		return fmt.Errorf("unknown command %s", command)
+	}
+	goalMode := params.Goal != "" || command == commandDrain
+	if goalMode && (params.RelAmountFrom > 0 || params.RelAmountTo > 0) {
+		return fmt.Errorf("goal mode calculates relative amounts itself, use --amount to limit a single payment")
+	}
+	if params.GoalFeeBudget > 0 && !goalMode {
+		return fmt.Errorf("goal fee budget can only be used with --goal or drain command")
+	}
+	if goalMode && (params.TotalAmount > 0 || params.MaxRebalances > 0) {
+		return fmt.Errorf("total amount and max rebalances can't be used with --goal or drain command")
+	}
+	if params.TotalAmount > 0 && params.MinAmount > params.TotalAmount {
+		return fmt.Errorf("minimum amount should be less than total amount")
+	}
+	if params.Amount == 0 && params.RelAmountFrom == 0 && params.RelAmountTo == 0 && params.TotalAmount == 0 &&
+		!goalMode && command != commandROI && command != commandCache {
 		return fmt.Errorf("no amount specified, use either --amount, --rel-amount-from, or --rel-amount-to")
 	}
 	if params.FailTolerance == 0 {
 		params.FailTolerance = 1000
 	}
 
-	if (params.RelAmountFrom > 0 || params.RelAmountTo > 0) && params.AllowRapidRebalance {
-		return fmt.Errorf("use either relative amounts or rapid rebalance but not both")
+	if (params.Simulate != "" || params.Replay != "") && params.LoopOutFallback {
+		return fmt.Errorf("loop out fallback can't be used in simulation or replay")
+	}
+	if params.Record != "" && (params.Replay != "" || params.Simulate != "") ||
+		params.Replay != "" && params.Simulate != "" {
+		return fmt.Errorf("use only one of record, replay and simulate")
+	}
+	// channel closing is a streaming call and those aren't recorded
+	if (params.Record != "" || params.Replay != "") && command == commandDrain && params.DrainClose {
+		return fmt.Errorf("channel closing can't be recorded or replayed, drain without --drain-close")
+	}
+	if params.LoopOutFallback && params.LoopOutMaxPPM == 0 {
+		return fmt.Errorf("loop out fallback requires --loop-out-max-ppm")
+	}
+	if params.LoopOutFallback || command == commandAdvise {
+		if params.LoopAddress == "" {
+			params.LoopAddress = "localhost:8081"
+		}
+		if params.LoopTLSCert == "" {
+			params.LoopTLSCert = rebalancer.DefaultLoopPath(params.Network, "tls.cert")
+		}
+		if params.LoopMacaroon == "" {
+			params.LoopMacaroon = rebalancer.DefaultLoopPath(params.Network, "loop.macaroon")
+		}
+	}
+	if params.CostBasisFilename != "" && params.StatFilename == "" {
+		return fmt.Errorf("cost basis tracking requires the stat file (--stat)")
+	}
+	if params.FeeGuardMargin != 0 && !params.FeeGuard {
+		return fmt.Errorf("fee guard margin can only be used with --fee-guard")
 	}
 	if params.NodeCacheLifetime == 0 {
 		params.NodeCacheLifetime = 1440
 	}
 	if len(params.ExcludeChannels) > 0 || len(params.ExcludeNodes) > 0 {
-		log.Print(infoColor("--exclude-channel and exclude_channel parameter are deprecated, use --exclude or exclude parameter instead for both channels and nodes"))
+		log.Print(format.Info("--exclude-channel and exclude_channel parameter are deprecated, use --exclude or exclude parameter instead for both channels and nodes"))
 		if len(params.Exclude) > 0 {
 			return fmt.Errorf("can't use --exclude and --exclude-channel/--exclude-node (or config parameters) at the same time")
 		}
 	}
 	if params.AllowUnbalanceFrom || params.AllowUnbalanceTo {
-		log.Print(infoColor("--allow-unbalance-from/to are deprecated and enabled by default, please remove them from your config or command line parameters"))
+		log.Print(format.Info("--allow-unbalance-from/to are deprecated and enabled by default, please remove them from your config or command line parameters"))
 	}
 	if len(params.ExcludeChannelsIn) > 0 {
-		log.Print(infoColor("--exclude-channel-in are deprecated use --exclude-to instead, please remove them from your config or command line parameters"))
+		log.Print(format.Info("--exclude-channel-in are deprecated use --exclude-to instead, please remove them from your config or command line parameters"))
 		if len(params.ExcludeTo) > 0 {
 			return fmt.Errorf("can't use --exclude-to and --exclude-channel-in (or config parameters) at the same time")
 		}
 	}
 	if len(params.ExcludeChannelsOut) > 0 {
-		log.Print(infoColor("--exclude-channel-out are deprecated use --exclude-from instead, please remove them from your config or command line parameters"))
+		log.Print(format.Info("--exclude-channel-out are deprecated use --exclude-from instead, please remove them from your config or command line parameters"))
 		if len(params.ExcludeFrom) > 0 {
 			return fmt.Errorf("can't use --exclude-from and --exclude-channel-out (or config parameters) at the same time")
 		}
@@ -267,12 +367,10 @@ func main() {
 		os.Exit(exitCode)
 	}()
 
-	rand.Seed(time.Now().UnixNano())
-
 	loadConfig()
 	parser := flags.NewParser(&params, flags.PrintErrors|flags.PassDoubleDash)
 
-	_, err := parser.Parse()
+	args, err := parser.Parse()
 
 	if err != nil {
 		os.Exit(1)
@@ -294,131 +392,261 @@ func main() {
 		return
 	}
 
-	err = preflightChecks(&params)
+	err = preflightChecks(&params, args)
 
 	if err != nil {
-		log.Fatal(errColor(err))
+		log.Fatal(format.Err(err))
+	}
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
 	}
 
-	conn, err := lndclient.NewBasicConn(params.Connect, params.TLSCert, params.MacaroonDir, params.Network,
-		lndclient.MacFilename(params.MacaroonFilename))
-	if err != nil {
-		log.Fatal(err)
-	}
-	r := regolancer{
-		nodeCache:    map[string]cachedNodeInfo{},
-		chanCache:    map[uint64]*lnrpc.ChannelEdge{},
-		channelPairs: map[string][2]*lnrpc.Channel{},
-		failureCache: map[string]failedRoute{},
-		mcCache:      map[string]int64{},
-		statFilename: params.StatFilename,
-	}
-	r.lnClient = lnrpc.NewLightningClient(conn)
-	r.routerClient = routerrpc.NewRouterClient(conn)
-	mainCtx, mainCtxCancel := context.WithTimeout(context.Background(), time.Minute*time.Duration(params.TimeoutRebalance))
-	defer mainCtxCancel()
-	infoCtx, infoCtxCancel := context.WithTimeout(mainCtx, time.Second*time.Duration(params.TimeoutInfo))
-	defer infoCtxCancel()
-	info, err := r.lnClient.GetInfo(infoCtx, &lnrpc.GetInfoRequest{})
-	if err != nil {
-		log.Fatal(err)
+	var clients rebalancer.Clients
+	opts := params.options(command, args)
+	if command == commandCache && len(args) > 2 {
+		// the graph file has everything to fill the caches, lnd isn't needed
+		r := rebalancer.NewOffline(opts, rebalancer.Events{Log: logMessage})
+		defer r.SaveNodeCache()
+		defer r.SaveChanCache()
+		exitCode = importGraph(context.Background(), r, args[2])
+		return
 	}
-	r.myPK = info.IdentityPubkey
-	r.blockHeight = info.BlockHeight
-	err = r.getChannels(infoCtx)
-	if err != nil {
-		log.Fatal("Error listing own channels: ", err)
+	// the calls answered from the cache files aren't recorded and the replay
+	// shouldn't depend on the files of whoever replays it
+	if (params.Record != "" || params.Replay != "") && (opts.NodeCacheFilename != "" || opts.ChanCacheFilename != "") {
+		log.Print(format.Info("Node and channel cache files are not used when recording or replaying"))
+		opts.NodeCacheFilename, opts.ChanCacheFilename = "", ""
 	}
-
-	if len(params.From) > 0 {
-		r.fromChannelId = r.filterChannels(infoCtx, params.From)
-		if len(r.fromChannelId) == 0 {
-			log.Fatal("No source nodes/channels selected, check if the ID is correct and node is online")
+	if params.Simulate != "" {
+		network, err := simulator.Load(params.Simulate)
+		if err != nil {
+			log.Fatal(format.ErrF("Error loading simulated network: %s", err))
 		}
-	}
-	if len(params.To) > 0 {
-		r.toChannelId = r.filterChannels(infoCtx, params.To)
-		if len(r.toChannelId) == 0 {
-			log.Fatal("No target nodes/channels selected, check if the ID is correct and node is online")
+		log.Print(format.Info("Running in the simulated network, no real payments are made"))
+		clients = rebalancer.Clients{
+			Lightning: network.Lightning(),
+			Router:    network.Router(),
+			WalletKit: network.WalletKit(),
 		}
-	}
-
-	if len(params.ExcludeFrom) > 0 {
-		r.excludeFrom = r.filterChannels(infoCtx, params.ExcludeFrom)
-	} else {
-		r.excludeFrom = makeChanSet(convertChanStringToInt(params.ExcludeChannelsOut))
-	}
-
-	if len(params.ExcludeTo) > 0 {
-		r.excludeTo = r.filterChannels(infoCtx, params.ExcludeTo)
 	} else {
-		r.excludeTo = makeChanSet(convertChanStringToInt(params.ExcludeChannelsIn))
-	}
-
-	r.excludeBoth = makeChanSet(convertChanStringToInt(params.ExcludeChannels))
-	err = r.makeNodeList(params.ExcludeNodes)
-	if err != nil {
-		log.Fatal("Error parsing excluded node list: ", err)
+		var conn grpc.ClientConnInterface
+		if params.Replay != "" {
+			replayer, err := recorder.NewReplayer(params.Replay)
+			if err != nil {
+				log.Fatal(format.ErrF("Error loading recording: %s", err))
+			}
+			log.Print(format.Info("Replaying the recorded session, no real payments are made"))
+			defer func() {
+				if left := replayer.Left(); left > 0 {
+					log.Printf("%s recorded calls were not replayed, the session diverged from the recording",
+						format.HiWhite(left))
+				}
+				if mismatches := replayer.Mismatches(); mismatches > 0 {
+					log.Printf("%s calls were answered with the responses to different requests, the session "+
+						"diverged from the recording", format.HiWhite(mismatches))
+				}
+			}()
+			replayer.Warn = func(msg string) { logErrorF("%s", msg) }
+			opts.Seed = replayer.Seed()
+			opts.Now = replayer.Now
+			conn = replayer
+		} else {
+			lndConn, err := lndclient.NewBasicConn(params.Connect, params.TLSCert, params.MacaroonDir, params.Network,
+				lndclient.MacFilename(params.MacaroonFilename))
+			if err != nil {
+				log.Fatal(err)
+			}
+			conn = lndConn
+			if params.Record != "" {
+				opts.Seed = time.Now().UnixNano()
+				rec, err := recorder.NewRecorder(lndConn, params.Record, opts.Seed)
+				if err != nil {
+					log.Fatal(format.ErrF("Error creating recording: %s", err))
+				}
+				defer func() {
+					if err := rec.Close(); err != nil {
+						logErrorF("Recording is incomplete: %s", err)
+					}
+				}()
+				conn = rec
+			}
+		}
+		clients = rebalancer.Clients{
+			Lightning: lnrpc.NewLightningClient(conn),
+			Router:    routerrpc.NewRouterClient(conn),
+			WalletKit: walletrpc.NewWalletKitClient(conn),
+		}
 	}
-
-	if len(params.Exclude) > 0 {
-		chans, nodes, err := parseNodeChannelIDs(params.Exclude)
+	if params.LoopOutFallback || command == commandAdvise && params.Replay == "" && params.Simulate == "" {
+		clients.Swap, err = rebalancer.NewLoopClient(params.LoopAddress, params.LoopTLSCert, params.LoopMacaroon)
 		if err != nil {
-			log.Fatal("Error parsing excluded node/channel list:", err)
+			if params.LoopOutFallback {
+				log.Fatal("Error connecting to loopd: ", err)
+			}
+			log.Printf("Swap quotes are not available: %s", err)
 		}
-		r.excludeBoth = chans
-		r.excludeNodes = nodes
 	}
-
-	r.invoiceCache = map[int64]*lnrpc.AddInvoiceResponse{}
-
-	err = r.getChannelCandidates(params.FromPerc, params.ToPerc, params.Amount)
-
+	r, err := rebalancer.New(context.Background(), clients, opts, rebalancer.Events{
+		Log:   logMessage,
+		Route: printRoute,
+	})
 	if err != nil {
-		log.Fatal("Error choosing channels: ", err)
+		log.Fatal(format.Err(err))
 	}
-	if len(r.fromChannels) == 0 {
-		log.Fatal("No source channels selected")
-	}
-	if len(r.toChannels) == 0 {
-		log.Fatal("No target channels selected")
+	defer r.SaveNodeCache()
+	defer r.SaveChanCache()
+	infoCtx, infoCtxCancel := context.WithTimeout(context.Background(), time.Second*time.Duration(params.TimeoutInfo))
+	defer infoCtxCancel()
+	if command == commandROI {
+		report, err := r.ROI(infoCtx, params.StatFilename)
+		if err != nil {
+			logErrorF("Error making ROI report: %s", err)
+			exitCode = 1
+			return
+		}
+		printROI(report)
+		return
 	}
-	attempt := 1
-
-	err = r.loadNodeCache(params.NodeCacheFilename, params.NodeCacheLifetime,
-		true)
-	if err != nil {
-		logErrorF("%s", err)
+	if command == commandCache {
+		exitCode = importGraph(infoCtx, r, "")
+		return
 	}
-	defer r.saveNodeCache(params.NodeCacheFilename, params.NodeCacheLifetime)
 	if params.Info {
-		err = r.info(infoCtx)
+		info, err := r.Info(infoCtx)
 		if err != nil {
 			log.Fatal(err)
 		}
+		printInfo(info, params.NodeCacheInfo)
 		return
 	}
 	infoCtxCancel()
+	if command == commandProbe {
+		result, err := r.Probe(context.Background(), args[1:], params.Amount)
+		if err != nil {
+			logErrorF("Error probing: %s", err)
+			exitCode = 1
+			return
+		}
+		printProbeResult(result)
+		if result.AmountSat == 0 {
+			exitCode = 1
+		}
+		return
+	}
+	if command == commandAdvise {
+		advice, err := r.Advise(context.Background(), params.Amount, params.AdviseConfTarget)
+		if err != nil {
+			logErrorF("Error advising: %s", err)
+			exitCode = 1
+			return
+		}
+		printAdvice(advice)
+		return
+	}
 	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt)
 	go func() {
 		<-stopChan
-		r.saveNodeCache(params.NodeCacheFilename, params.NodeCacheLifetime)
+		r.SaveNodeCache()
+		r.SaveChanCache()
+		saveCostBasis(r)
 		os.Exit(1)
 	}()
 
-	for {
-		err, retry := r.tryRebalance(mainCtx, &attempt)
-		if mainCtx.Err() == context.DeadlineExceeded {
-			log.Println(errColor("Rebalancing timed out"))
-			exitCode = 2
-			return
-		}
-		if !retry {
+	result, err := r.Rebalance(context.Background())
+	saveCostBasis(r)
+	if err == rebalancer.ErrTimeout {
+		exitCode = 2
+	} else if err != nil {
+		logErrorF("Rebalance failed: %s", err)
+		exitCode = 1
+	}
+	if params.TotalAmount > 0 || params.MaxRebalances > 0 {
+		printPairSummary(result)
+	}
+	if command == commandDrain {
+		printDrainResult(args[1], result)
+		if params.DrainClose {
+			if !result.GoalReached {
+				log.Print(format.Err("Channel is not drained, not closing it"))
+				exitCode = 1
+				return
+			}
+			closeCtx, closeCtxCancel := context.WithTimeout(context.Background(), time.Second*time.Duration(params.TimeoutInfo))
+			defer closeCtxCancel()
+			txid, err := r.CloseDrainedChannel(closeCtx, params.DrainCloseFeeRate)
 			if err != nil {
+				logErrorF("Error closing channel: %s", err)
 				exitCode = 1
+				return
 			}
-			return
+			log.Printf("Closing transaction broadcast: %s", format.Info(txid))
 		}
 	}
 }
+
+// options converts the parameters to the rebalancer options, the deprecated
+// exclusion parameters are used if the new ones are not set
+func (p *configParams) options(command string, args []string) rebalancer.Options {
+	opts := rebalancer.Options{
+		FromPerc:                 p.FromPerc,
+		ToPerc:                   p.ToPerc,
+		Amount:                   p.Amount,
+		RelAmountTo:              p.RelAmountTo,
+		RelAmountFrom:            p.RelAmountFrom,
+		MinAmount:                p.MinAmount,
+		ProbeSteps:               p.ProbeSteps,
+		ProbeParallel:            p.ProbeParallel,
+		TargetFirst:              p.TargetFirst,
+		AllowRapidRebalance:      p.AllowRapidRebalance,
+		RapidStrategy:            p.RapidStrategy,
+		From:                     p.From,
+		To:                       p.To,
+		ExcludeFrom:              p.ExcludeFrom,
+		ExcludeTo:                p.ExcludeTo,
+		Exclude:                  p.Exclude,
+		ExcludeChannelAge:        p.ExcludeChannelAge,
+		FailTolerance:            p.FailTolerance,
+		EconRatio:                p.EconRatio,
+		EconRatioMaxPPM:          p.EconRatioMaxPPM,
+		EconForwardsDays:         p.EconForwardsDays,
+		EconForwardsMinPPM:       p.EconForwardsMinPPM,
+		EconForwardsMinVolume:    p.EconForwardsMinVolume,
+		EconForwardsNoHistoryPPM: p.EconForwardsNoHistoryPPM,
+		FeeLimitPPM:              p.FeeLimitPPM,
+		LostProfit:               p.LostProfit,
+		Goal:                     p.Goal,
+		GoalFeeBudget:            p.GoalFeeBudget,
+		TotalAmount:              p.TotalAmount,
+		MaxRebalances:            p.MaxRebalances,
+		LoopOutFallback:          p.LoopOutFallback,
+		LoopOutMaxPPM:            p.LoopOutMaxPPM,
+		CostBasisFilename:        p.CostBasisFilename,
+		FeeGuard:                 p.FeeGuard,
+		FeeGuardMargin:           p.FeeGuardMargin,
+		NodeCacheFilename:        p.NodeCacheFilename,
+		NodeCacheLifetime:        p.NodeCacheLifetime,
+		ChanCacheFilename:        p.ChanCacheFilename,
+		ChanCacheLifetime:        p.ChanCacheLifetime,
+		TimeoutRebalance:         p.TimeoutRebalance,
+		TimeoutAttempt:           p.TimeoutAttempt,
+		TimeoutInfo:              p.TimeoutInfo,
+		TimeoutRoute:             p.TimeoutRoute,
+		StatFilename:             p.StatFilename,
+	}
+	if len(opts.ExcludeFrom) == 0 {
+		opts.ExcludeFrom = p.ExcludeChannelsOut
+	}
+	if len(opts.ExcludeTo) == 0 {
+		opts.ExcludeTo = p.ExcludeChannelsIn
+	}
+	if len(opts.Exclude) == 0 {
+		opts.Exclude = append(append([]string{}, p.ExcludeChannels...), p.ExcludeNodes...)
+	}
+	if command == commandDrain {
+		opts.Drain = args[1]
+		opts.DrainThreshold = p.DrainThreshold
+	}
+	return opts
+}
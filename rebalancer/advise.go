@@ -0,0 +1,102 @@
+package rebalancer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc/walletrpc"
+)
+
+// fundingTxWeight is the weight of a typical channel funding transaction with
+// one P2WKH input, the P2WSH funding output and P2WKH change
+const fundingTxWeight = 612
+
+// ChannelAdvice compares the fees of refilling the channel in different ways,
+// negative fees mean the option is not available
+type ChannelAdvice struct {
+	ChannelInfo
+	RebalanceFeeMsat int64
+	SwapFeeMsat      int64
+	OpenFeeMsat      int64
+}
+
+// Advice is the comparison for all target channels
+type Advice struct {
+	AmountSat   int64
+	SwapFeeMsat int64
+	OpenFeeMsat int64
+	Channels    []ChannelAdvice
+}
+
+// Recommendation returns the cheapest available option
+func (a ChannelAdvice) Recommendation() string {
+	best := int64(math.MaxInt64)
+	result := "none"
+	for _, opt := range []struct {
+		name string
+		fee  int64
+	}{{"rebalance", a.RebalanceFeeMsat}, {"swap", a.SwapFeeMsat}, {"open", a.OpenFeeMsat}} {
+		if opt.fee >= 0 && opt.fee < best {
+			best = opt.fee
+			result = opt.name
+		}
+	}
+	return result
+}
+
+// openFeeMsat estimates the on-chain fee of opening a new channel at the
+// current fee rate
+func (r *Rebalancer) openFeeMsat(ctx context.Context, confTarget int32) (int64, error) {
+	fee, err := r.walletClient.EstimateFee(ctx, &walletrpc.EstimateFeeRequest{ConfTarget: confTarget})
+	if err != nil {
+		return 0, err
+	}
+	return fee.SatPerKw * fundingTxWeight, nil
+}
+
+// Advise compares the cost of refilling every target channel using circular
+// rebalance, Loop In swap or opening a new channel, rebalance fees are for the
+// cheapest route within the fee limit
+func (r *Rebalancer) Advise(ctx context.Context, amount int64, confTarget int32) (*Advice, error) {
+	if len(r.toChannels) == 0 {
+		return nil, fmt.Errorf("no target channels selected")
+	}
+	openFeeMsat, err := r.openFeeMsat(ctx, confTarget)
+	if err != nil {
+		return nil, fmt.Errorf("error estimating on-chain fee: %s", err)
+	}
+	swapFeeMsat := int64(-1)
+	if r.swap != nil {
+		quote, err := r.swap.LoopInQuote(ctx, amount)
+		if err != nil {
+			r.errorf("Error getting loop in quote: %s", err)
+		} else {
+			swapFeeMsat = (quote.SwapFeeSat + quote.HtlcPublishFeeSat) * 1000
+		}
+	}
+	amtMsat := amount * 1000
+	result := &Advice{AmountSat: amount, SwapFeeMsat: swapFeeMsat, OpenFeeMsat: openFeeMsat}
+	for _, c := range r.toChannels {
+		sources := []uint64{}
+		for _, from := range r.pairs.sources(c.ChanId) {
+			sources = append(sources, from.ChanId)
+		}
+		advice := ChannelAdvice{RebalanceFeeMsat: -1, SwapFeeMsat: swapFeeMsat, OpenFeeMsat: openFeeMsat}
+		if len(sources) > 0 {
+			routeCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(r.opts.TimeoutRoute))
+			routes, err := r.getRoutesFromAny(routeCtx, sources, c.ChanId, amtMsat)
+			cancel()
+			if err == nil {
+				advice.RebalanceFeeMsat = routes[0].TotalFeesMsat
+			}
+		}
+		advice.ChannelInfo, err = r.channelInfo(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		result.Channels = append(result.Channels, advice)
+	}
+	return result, nil
+}
@@ -0,0 +1,101 @@
+package rebalancer
+
+import (
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// weight of a non-dust HTLC output in the commitment transaction
+const htlcWeight = 172
+
+// commitFeeBufferMsat is the fee the channel initiator should be able to pay
+// on top of the current commitment fee to add one more HTLC. Lnd keeps the
+// commitment payable at twice the current fee rate. The current commitment
+// fee and the anchor outputs are already deducted from the initiator balance
+// reported by lnd.
+func commitFeeBufferMsat(c *lnrpc.Channel) int64 {
+	if c.CommitWeight == 0 {
+		return 0
+	}
+	feePerKw := c.CommitFee * 1000 / c.CommitWeight
+	return (2*feePerKw*(c.CommitWeight+htlcWeight)/1000 - c.CommitFee) * 1000
+}
+
+func pendingHtlcs(c *lnrpc.Channel, incoming bool) (count uint32, amtMsat int64) {
+	for _, htlc := range c.PendingHtlcs {
+		if htlc.Incoming == incoming {
+			count++
+			amtMsat += htlc.Amount * 1000
+		}
+	}
+	return
+}
+
+// cachedMaxHtlcMsat returns the max HTLC from the node policy if the channel
+// info is cached, zero otherwise. Routes check the policies anyway, it only
+// helps to not pick amounts that can't pass.
+func (r *Rebalancer) cachedMaxHtlcMsat(chanId uint64, node string) int64 {
+	edge, ok := r.chanCache[chanId]
+	if !ok {
+		return 0
+	}
+	policy := edge.Node1Policy
+	if edge.Node2Pub == node {
+		policy = edge.Node2Policy
+	}
+	if policy == nil {
+		return 0
+	}
+	return int64(policy.MaxHtlcMsat)
+}
+
+// htlcLimitMsat caps the balance the side can spend by the constraints it has
+// to follow offering an HTLC, zero is returned if no HTLC can be offered
+func htlcLimitMsat(balanceMsat int64, constraints *lnrpc.ChannelConstraints, pendingCount uint32,
+	pendingMsat int64, maxHtlcMsat int64) int64 {
+	if maxHtlcMsat > 0 {
+		balanceMsat = min(balanceMsat, maxHtlcMsat)
+	}
+	if constraints != nil {
+		if constraints.MaxAcceptedHtlcs > 0 && pendingCount >= constraints.MaxAcceptedHtlcs {
+			return 0
+		}
+		if constraints.MaxPendingAmtMsat > 0 {
+			balanceMsat = min(balanceMsat, int64(constraints.MaxPendingAmtMsat)-pendingMsat)
+		}
+		if balanceMsat < int64(constraints.MinHtlcMsat) {
+			return 0
+		}
+	}
+	if balanceMsat < 0 {
+		return 0
+	}
+	return balanceMsat
+}
+
+// sendableMsat is how much we can send through the channel in one HTLC
+func (r *Rebalancer) sendableMsat(c *lnrpc.Channel) int64 {
+	balanceMsat := c.LocalBalance * 1000
+	if c.LocalConstraints != nil {
+		balanceMsat -= int64(c.LocalConstraints.ChanReserveSat) * 1000
+	}
+	if c.Initiator {
+		balanceMsat -= commitFeeBufferMsat(c)
+	}
+	count, pendingMsat := pendingHtlcs(c, false)
+	return htlcLimitMsat(balanceMsat, c.LocalConstraints, count, pendingMsat, r.cachedMaxHtlcMsat(c.ChanId, r.myPK))
+}
+
+// receivableMsat is how much the peer can send us through the channel in one
+// HTLC
+func (r *Rebalancer) receivableMsat(c *lnrpc.Channel) int64 {
+	balanceMsat := c.RemoteBalance * 1000
+	if c.RemoteConstraints != nil {
+		balanceMsat -= int64(c.RemoteConstraints.ChanReserveSat) * 1000
+	}
+	if !c.Initiator {
+		balanceMsat -= commitFeeBufferMsat(c)
+	}
+	count, pendingMsat := pendingHtlcs(c, true)
+	return htlcLimitMsat(balanceMsat, c.RemoteConstraints, count, pendingMsat,
+		r.cachedMaxHtlcMsat(c.ChanId, c.RemotePubkey))
+}
@@ -0,0 +1,70 @@
+package rebalancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func TestSpendableMsat(t *testing.T) {
+	// 2530 sat/kw commitment, the buffer for one more HTLC at twice the fee
+	// rate is 3400 sat
+	tests := []struct {
+		name       string
+		ch         *lnrpc.Channel
+		localMax   uint64
+		remoteMax  uint64
+		sendable   int64
+		receivable int64
+	}{
+		{name: "balance", ch: &lnrpc.Channel{LocalBalance: 1_000_000, RemoteBalance: 500_000},
+			sendable: 1_000_000_000, receivable: 500_000_000},
+		{name: "reserve", ch: &lnrpc.Channel{LocalBalance: 1_000_000, RemoteBalance: 500_000,
+			LocalConstraints:  &lnrpc.ChannelConstraints{ChanReserveSat: 10_000},
+			RemoteConstraints: &lnrpc.ChannelConstraints{ChanReserveSat: 20_000}},
+			sendable: 990_000_000, receivable: 480_000_000},
+		{name: "below reserve", ch: &lnrpc.Channel{LocalBalance: 5_000, RemoteBalance: 5_000,
+			LocalConstraints:  &lnrpc.ChannelConstraints{ChanReserveSat: 10_000},
+			RemoteConstraints: &lnrpc.ChannelConstraints{ChanReserveSat: 10_000}}},
+		{name: "we pay commit fee", ch: &lnrpc.Channel{LocalBalance: 1_000_000, RemoteBalance: 500_000,
+			Initiator: true, CommitFee: 2530, CommitWeight: 1000},
+			sendable: 996_600_000, receivable: 500_000_000},
+		{name: "peer pays commit fee", ch: &lnrpc.Channel{LocalBalance: 1_000_000, RemoteBalance: 500_000,
+			CommitFee: 2530, CommitWeight: 1000},
+			sendable: 1_000_000_000, receivable: 496_600_000},
+		{name: "pending amount", ch: &lnrpc.Channel{LocalBalance: 1_000_000, RemoteBalance: 500_000,
+			LocalConstraints:  &lnrpc.ChannelConstraints{MaxPendingAmtMsat: 500_000_000},
+			RemoteConstraints: &lnrpc.ChannelConstraints{MaxPendingAmtMsat: 500_000_000},
+			PendingHtlcs:      []*lnrpc.HTLC{{Amount: 100_000}, {Incoming: true, Amount: 50_000}}},
+			sendable: 400_000_000, receivable: 450_000_000},
+		{name: "no free slots", ch: &lnrpc.Channel{LocalBalance: 1_000_000, RemoteBalance: 500_000,
+			LocalConstraints:  &lnrpc.ChannelConstraints{MaxAcceptedHtlcs: 2},
+			RemoteConstraints: &lnrpc.ChannelConstraints{MaxAcceptedHtlcs: 2},
+			PendingHtlcs:      []*lnrpc.HTLC{{Amount: 1000}, {Amount: 1000}, {Incoming: true, Amount: 1000}}},
+			sendable: 0, receivable: 500_000_000},
+		{name: "below min htlc", ch: &lnrpc.Channel{LocalBalance: 10, RemoteBalance: 500_000,
+			LocalConstraints: &lnrpc.ChannelConstraints{MinHtlcMsat: 20_000}},
+			sendable: 0, receivable: 500_000_000},
+		{name: "cached max htlc", ch: &lnrpc.Channel{LocalBalance: 1_000_000, RemoteBalance: 500_000},
+			localMax: 300_000_000, remoteMax: 200_000_000, sendable: 300_000_000, receivable: 200_000_000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ch.ChanId = 1
+			tt.ch.RemotePubkey = testPeerPK
+			r := &Rebalancer{myPK: testPK, chanCache: map[uint64]cachedChanInfo{}}
+			if tt.localMax > 0 || tt.remoteMax > 0 {
+				r.chanCache[1] = newCachedChanInfo(&lnrpc.ChannelEdge{ChannelId: 1, Node1Pub: testPeerPK, Node2Pub: testPK,
+					Node1Policy: &lnrpc.RoutingPolicy{MaxHtlcMsat: tt.remoteMax},
+					Node2Policy: &lnrpc.RoutingPolicy{MaxHtlcMsat: tt.localMax}}, time.Now())
+			}
+			if sendable := r.sendableMsat(tt.ch); sendable != tt.sendable {
+				t.Errorf("sendable %d msat, expected %d msat", sendable, tt.sendable)
+			}
+			if receivable := r.receivableMsat(tt.ch); receivable != tt.receivable {
+				t.Errorf("receivable %d msat, expected %d msat", receivable, tt.receivable)
+			}
+		})
+	}
+}
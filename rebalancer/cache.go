@@ -0,0 +1,321 @@
+package rebalancer
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// cached edges are never refetched sooner than this
+const minChanCacheTTL = time.Minute * 10
+
+type cachedChanInfo struct {
+	*lnrpc.ChannelEdge
+	Timestamp time.Time
+	// gob doesn't save the unknown fields of the policies so the inbound fees
+	// are saved separately
+	InboundFees [2]InboundFee
+}
+
+func newCachedChanInfo(edge *lnrpc.ChannelEdge, timestamp time.Time) cachedChanInfo {
+	return cachedChanInfo{
+		ChannelEdge: edge,
+		Timestamp:   timestamp,
+		InboundFees: [2]InboundFee{GetInboundFee(edge.Node1Policy), GetInboundFee(edge.Node2Policy)},
+	}
+}
+
+// restoreInboundFees puts the saved inbound fees back to the policies after
+// loading the cache
+func (c cachedChanInfo) restoreInboundFees() {
+	for i, p := range []*lnrpc.RoutingPolicy{c.Node1Policy, c.Node2Policy} {
+		if c.InboundFees[i] != (InboundFee{}) {
+			SetInboundFee(p, c.InboundFees[i])
+		}
+	}
+}
+
+// lastUpdate returns the time of the latest policy update of the edge
+func (c cachedChanInfo) lastUpdate() time.Time {
+	lastUpdate := c.LastUpdate
+	for _, p := range []*lnrpc.RoutingPolicy{c.Node1Policy, c.Node2Policy} {
+		if p != nil && p.LastUpdate > lastUpdate {
+			lastUpdate = p.LastUpdate
+		}
+	}
+	return time.Unix(int64(lastUpdate), 0)
+}
+
+// expired reports if the edge should be fetched again. The policies that
+// hadn't changed for a long time before they were fetched are likely to stay
+// the same for as long, the recently updated ones expire sooner, the lifetime
+// (in minutes) is the limit.
+func (c cachedChanInfo) expired(lifetime int, now time.Time) bool {
+	ttl := c.Timestamp.Sub(c.lastUpdate())
+	if ttl < minChanCacheTTL {
+		ttl = minChanCacheTTL
+	}
+	if ttl > time.Minute*time.Duration(lifetime) {
+		ttl = time.Minute * time.Duration(lifetime)
+	}
+	return now.Sub(c.Timestamp) > ttl
+}
+
+func lock() *flock.Flock {
+	return flock.New(filepath.Join(os.TempDir(), "regolancer.lock"))
+}
+
+func (r *Rebalancer) loadNodeCache(filename string, exp int, doLock bool) error {
+	if filename == "" {
+		return nil
+	}
+	defer func() {
+		err := recover()
+		if err == nil {
+			return
+		}
+		r.logf("Loading failed, cache format might be outdated: %s", err)
+		r.nodeCache = map[string]cachedNodeInfo{}
+	}()
+	if doLock {
+		r.logf("Loading node cache from %s", filename)
+		l := lock()
+		err := l.RLock()
+		defer l.Unlock()
+
+		if err != nil {
+			return fmt.Errorf("error taking shared lock on file %s: %s", filename, err)
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("error opening node cache file: %s", err)
+		}
+		return nil
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&r.nodeCache)
+	if err != nil {
+		return err
+	}
+	for k, v := range r.nodeCache {
+		since := r.now().Sub(v.Timestamp)
+		if since > time.Minute*time.Duration(exp) {
+			delete(r.nodeCache, k)
+		}
+	}
+	return nil
+}
+
+func (r *Rebalancer) saveNodeCache(filename string, exp int) error {
+	if filename == "" {
+		return nil
+	}
+	r.logf("Saving node cache to %s", filename)
+
+	l := lock()
+	err := l.Lock()
+	defer l.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("error taking exclusive lock on file %s: %s", filename, err)
+	}
+
+	old := Rebalancer{nodeCache: map[string]cachedNodeInfo{}}
+	err = old.loadNodeCache(filename, exp, false)
+
+	if err != nil {
+		r.errorf("Error merging cache, saving anew: %s", err)
+	}
+	for k, v := range old.nodeCache {
+		if n, ok := r.nodeCache[k]; !ok ||
+			n.Timestamp.Before(v.Timestamp) {
+			r.nodeCache[k] = v
+		}
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating node cache file: %s", err)
+	}
+	defer f.Close()
+	err = gob.NewEncoder(f).Encode(r.nodeCache)
+	return err
+}
+
+func (r *Rebalancer) loadChanCache(filename string, exp int, doLock bool) error {
+	if filename == "" {
+		return nil
+	}
+	defer func() {
+		err := recover()
+		if err == nil {
+			return
+		}
+		r.logf("Loading failed, cache format might be outdated: %s", err)
+		r.chanCache = map[uint64]cachedChanInfo{}
+	}()
+	if doLock {
+		r.logf("Loading channel cache from %s", filename)
+		l := lock()
+		err := l.RLock()
+		defer l.Unlock()
+
+		if err != nil {
+			return fmt.Errorf("error taking shared lock on file %s: %s", filename, err)
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("error opening channel cache file: %s", err)
+		}
+		return nil
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&r.chanCache)
+	if err != nil {
+		return err
+	}
+	for k, v := range r.chanCache {
+		if v.ChannelEdge == nil || v.expired(exp, r.now()) {
+			delete(r.chanCache, k)
+			continue
+		}
+		v.restoreInboundFees()
+	}
+	return nil
+}
+
+func (r *Rebalancer) saveChanCache(filename string, exp int) error {
+	if filename == "" {
+		return nil
+	}
+	r.logf("Saving channel cache to %s", filename)
+
+	l := lock()
+	err := l.Lock()
+	defer l.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("error taking exclusive lock on file %s: %s", filename, err)
+	}
+
+	old := Rebalancer{chanCache: map[uint64]cachedChanInfo{}}
+	err = old.loadChanCache(filename, exp, false)
+
+	if err != nil {
+		r.errorf("Error merging cache, saving anew: %s", err)
+	}
+	// the edge with the latest policy update wins, the fetch time decides if
+	// the policies are the same
+	for k, v := range old.chanCache {
+		c, ok := r.chanCache[k]
+		if !ok || c.lastUpdate().Before(v.lastUpdate()) ||
+			c.lastUpdate().Equal(v.lastUpdate()) && c.Timestamp.Before(v.Timestamp) {
+			r.chanCache[k] = v
+		}
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating channel cache file: %s", err)
+	}
+	defer f.Close()
+	err = gob.NewEncoder(f).Encode(r.chanCache)
+	return err
+}
+
+// NewOffline creates the rebalancer that doesn't connect to lnd and only
+// works with the node and channel cache files, it's enough to import the graph
+// from a file with ImportGraph. Nothing else can be done with it.
+func NewOffline(opts Options, events Events) *Rebalancer {
+	opts.setDefaults()
+	r := &Rebalancer{
+		opts:      opts,
+		events:    events,
+		nodeCache: map[string]cachedNodeInfo{},
+		chanCache: map[uint64]cachedChanInfo{},
+	}
+	err := r.loadNodeCache(opts.NodeCacheFilename, opts.NodeCacheLifetime, true)
+	if err != nil {
+		r.errorf("%s", err)
+	}
+	err = r.loadChanCache(opts.ChanCacheFilename, opts.ChanCacheLifetime, true)
+	if err != nil {
+		r.errorf("%s", err)
+	}
+	return r
+}
+
+// ImportGraph fills the node and channel caches from the lncli describegraph
+// JSON dump or from lnd if the filename is empty, the dump entries get the
+// file modification time as the timestamp. Entries that are already cached and
+// not older than the graph are kept. Returns the number of nodes and channels
+// imported, the caches should be saved afterwards.
+func (r *Rebalancer) ImportGraph(ctx context.Context, filename string) (nodes int, edges int, err error) {
+	var graph *lnrpc.ChannelGraph
+	timestamp := r.now()
+	if filename != "" {
+		st, err := os.Stat(filename)
+		if err != nil {
+			return 0, 0, err
+		}
+		timestamp = st.ModTime()
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return 0, 0, err
+		}
+		graph, err = ParseGraph(data)
+		if err != nil {
+			return 0, 0, err
+		}
+	} else {
+		if r.lnClient == nil {
+			return 0, 0, fmt.Errorf("not connected to lnd, the graph file is required")
+		}
+		graph, err = r.lnClient.DescribeGraph(ctx, &lnrpc.ChannelGraphRequest{})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if r.now().Sub(timestamp) > time.Minute*time.Duration(r.opts.NodeCacheLifetime) {
+		r.errorf("The graph is older than the node cache lifetime, the nodes will expire on the next run")
+	}
+	// lnd calculates these for GetNodeInfo from the channels it knows
+	numChannels := map[string]uint32{}
+	totalCapacity := map[string]int64{}
+	for _, e := range graph.Edges {
+		for _, pk := range []string{e.Node1Pub, e.Node2Pub} {
+			numChannels[pk]++
+			totalCapacity[pk] += e.Capacity
+		}
+		if c, ok := r.chanCache[e.ChannelId]; ok && !c.Timestamp.Before(timestamp) {
+			continue
+		}
+		r.chanCache[e.ChannelId] = newCachedChanInfo(e, timestamp)
+		edges++
+	}
+	for _, n := range graph.Nodes {
+		if c, ok := r.nodeCache[n.PubKey]; ok && !c.Timestamp.Before(timestamp) {
+			continue
+		}
+		r.nodeCache[n.PubKey] = cachedNodeInfo{
+			NodeInfo: &lnrpc.NodeInfo{
+				Node:          n,
+				NumChannels:   numChannels[n.PubKey],
+				TotalCapacity: totalCapacity[n.PubKey],
+			},
+			Timestamp: timestamp,
+		}
+		nodes++
+	}
+	return nodes, edges, nil
+}
@@ -0,0 +1,95 @@
+package rebalancer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func TestChanCacheExpired(t *testing.T) {
+	fetched := time.Unix(1_000_000, 0)
+	tests := []struct {
+		name       string
+		lastUpdate time.Time
+		age        time.Duration
+		expired    bool
+	}{
+		// the policy was the same for 2 hours before it was fetched
+		{name: "stable policy", lastUpdate: fetched.Add(-2 * time.Hour), age: time.Hour},
+		{name: "stable policy expired", lastUpdate: fetched.Add(-2 * time.Hour), age: 3 * time.Hour, expired: true},
+		{name: "min ttl", lastUpdate: fetched, age: 5 * time.Minute},
+		{name: "lifetime", lastUpdate: fetched.Add(-48 * time.Hour), age: 25 * time.Hour, expired: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCachedChanInfo(&lnrpc.ChannelEdge{
+				Node1Policy: &lnrpc.RoutingPolicy{LastUpdate: uint32(tt.lastUpdate.Unix())},
+			}, fetched)
+			if expired := c.expired(24*60, fetched.Add(tt.age)); expired != tt.expired {
+				t.Fatalf("expired %v, expected %v", expired, tt.expired)
+			}
+		})
+	}
+}
+
+func TestChanCacheInboundFees(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "chans.dat")
+	policy := &lnrpc.RoutingPolicy{FeeBaseMsat: 1000, LastUpdate: uint32(time.Now().Unix())}
+	SetInboundFee(policy, InboundFee{RateMilliMsat: -20})
+	r := &Rebalancer{chanCache: map[uint64]cachedChanInfo{
+		1: newCachedChanInfo(&lnrpc.ChannelEdge{ChannelId: 1, Node1Policy: policy}, time.Now()),
+	}}
+	if err := r.saveChanCache(filename, 60); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Rebalancer{chanCache: map[uint64]cachedChanInfo{}}
+	if err := loaded.loadChanCache(filename, 60, true); err != nil {
+		t.Fatal(err)
+	}
+	edge := loaded.chanCache[1]
+	if edge.ChannelEdge == nil || edge.Node1Policy.FeeBaseMsat != 1000 ||
+		GetInboundFee(edge.Node1Policy) != (InboundFee{RateMilliMsat: -20}) {
+		t.Fatalf("channel not loaded: %+v", edge)
+	}
+}
+
+func TestImportGraphOffline(t *testing.T) {
+	dir := t.TempDir()
+	graphFile := filepath.Join(dir, "graph.json")
+	err := os.WriteFile(graphFile, []byte(`{"nodes": [{"pub_key": "a", "alias": "alice"}, {"pub_key": "b"}],
+		"edges": [{"channel_id": "1", "node1_pub": "a", "node2_pub": "b", "capacity": "1000000",
+		"node1_policy": {"fee_base_msat": "1000", "inbound_fee_rate_milli_msat": -20}}]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{NodeCacheFilename: filepath.Join(dir, "nodes.dat"), ChanCacheFilename: filepath.Join(dir, "chans.dat")}
+	r := NewOffline(opts, Events{})
+	if _, _, err := r.ImportGraph(context.Background(), ""); err == nil {
+		t.Fatal("imported from lnd without the connection")
+	}
+	nodes, edges, err := r.ImportGraph(context.Background(), graphFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes != 2 || edges != 1 {
+		t.Fatalf("imported %d nodes and %d channels", nodes, edges)
+	}
+	if err := r.SaveNodeCache(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SaveChanCache(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewOffline(opts, Events{})
+	if loaded.nodeCache["a"].Node.Alias != "alice" || loaded.nodeCache["a"].NumChannels != 1 {
+		t.Fatalf("node not saved: %+v", loaded.nodeCache["a"])
+	}
+	edge := loaded.chanCache[1]
+	if edge.ChannelEdge == nil || GetInboundFee(edge.Node1Policy) != (InboundFee{RateMilliMsat: -20}) {
+		t.Fatalf("channel not saved: %+v", edge)
+	}
+}
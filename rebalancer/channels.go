@@ -0,0 +1,375 @@
+package rebalancer
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/rkfg/regolancer/format"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	errNoPairs  = errors.New("no channelpairs available for rebalance")
+	errNoRoutes = errors.New("no routes")
+)
+
+func (r *Rebalancer) getChannels(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(r.opts.TimeoutRoute))
+	defer cancel()
+	channels, err := r.lnClient.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: true})
+	if err != nil {
+		return err
+	}
+	r.channels = channels.Channels
+	return nil
+}
+
+// refreshChannels updates the channels in place with their current state, only
+// the peers of these channels are queried and the channel selection and pairs
+// stay intact because they point to the same channels
+func (r *Rebalancer) refreshChannels(ctx context.Context, chanIds ...uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(r.opts.TimeoutRoute))
+	defer cancel()
+	fresh := map[uint64]*lnrpc.Channel{}
+	for _, chanId := range chanIds {
+		c := r.findChannel(chanId)
+		if c == nil {
+			return fmt.Errorf("channel %d not found or inactive", chanId)
+		}
+		if _, ok := fresh[c.ChanId]; ok {
+			continue
+		}
+		peer, err := hex.DecodeString(c.RemotePubkey)
+		if err != nil {
+			return err
+		}
+		channels, err := r.lnClient.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: true,
+			Peer: peer})
+		if err != nil {
+			return err
+		}
+		for _, pc := range channels.Channels {
+			fresh[pc.ChanId] = pc
+		}
+	}
+	for _, chanId := range chanIds {
+		f, ok := fresh[chanId]
+		if !ok {
+			return fmt.Errorf("channel %d not found or inactive", chanId)
+		}
+		c := r.findChannel(chanId)
+		proto.Reset(c)
+		proto.Merge(c, f)
+	}
+	return nil
+}
+
+func (r *Rebalancer) isSourceCandidate(c *lnrpc.Channel, fromPerc int64) bool {
+	return c.RemoteBalance < c.Capacity*fromPerc/100
+}
+
+func (r *Rebalancer) isTargetCandidate(c *lnrpc.Channel, toPerc int64) bool {
+	return c.LocalBalance < c.Capacity*toPerc/100
+}
+
+func makeChanSet(chanIds []uint64) (result map[uint64]struct{}) {
+	result = map[uint64]struct{}{}
+	for _, cid := range chanIds {
+		result[cid] = struct{}{}
+	}
+	return
+}
+
+func parseNodeChannelIDs(ids []string) (chans map[uint64]struct{}, nodes [][]byte, err error) {
+	chanIdStr := []string{}
+	nodePKStr := []string{}
+	for _, id := range ids {
+		if len(id) == 66 {
+			nodePKStr = append(nodePKStr, id)
+		} else {
+			chanIdStr = append(chanIdStr, id)
+		}
+	}
+	chanIds, err := convertChanStringToInt(chanIdStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	chans = makeChanSet(chanIds)
+	for _, pk := range nodePKStr {
+		nodePK, err := hex.DecodeString(pk)
+		if err != nil {
+			return nil, nil, err
+		}
+		nodes = append(nodes, nodePK)
+	}
+	return
+}
+
+func (r *Rebalancer) getChannelCandidates(fromPerc, toPerc, amount int64) error {
+
+	for _, c := range r.channels {
+
+		if r.opts.ExcludeChannelAge != 0 && uint64(r.blockHeight)-getChannelAge(c.ChanId) < r.opts.ExcludeChannelAge {
+			continue
+		}
+
+		if _, ok := r.excludeBoth[c.ChanId]; ok {
+			continue
+		}
+		if _, ok := r.excludeTo[c.ChanId]; !ok {
+			if _, ok := r.toChannelId[c.ChanId]; ok || len(r.toChannelId) == 0 {
+				if r.isTargetCandidate(c, toPerc) {
+					r.toChannels = append(r.toChannels, c)
+				}
+			}
+
+		}
+		if _, ok := r.excludeFrom[c.ChanId]; !ok {
+			if _, ok := r.fromChannelId[c.ChanId]; ok || len(r.fromChannelId) == 0 {
+				if r.isSourceCandidate(c, fromPerc) {
+					r.fromChannels = append(r.fromChannels, c)
+				}
+			}
+
+		}
+	}
+	r.pairs = newPairSpace(r.fromChannels, r.toChannels)
+	if r.pairs.len() > 0 {
+		return nil
+	} else {
+		return errNoPairs
+	}
+}
+
+func min(args ...int64) (result int64) {
+	result = math.MaxInt64
+	for _, a := range args {
+		if a < result {
+			result = a
+		}
+	}
+	return
+}
+
+// restoreFailedRoutes expires all failed routes if no channel pairs are left
+func (r *Rebalancer) restoreFailedRoutes() error {
+	if r.pairs.len() > 0 {
+		return nil
+	}
+	if !r.routeFound || r.pairs.failed() == 0 {
+		return errNoRoutes
+	}
+	r.log(format.Err("No channel pairs left, expiring all failed routes"))
+	r.pairs.expire(time.Time{})
+	r.mcCache = map[string]int64{}
+	r.routeFound = false
+	return nil
+}
+
+func (r *Rebalancer) pickChannelPair(amount, minAmount int64,
+	relFromAmount, relToAmount float64) (from uint64, to uint64, maxAmount int64, err error) {
+
+	for {
+		err = r.restoreFailedRoutes()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		fromChan, toChan := r.pairs.pair(r.pairs.pick(r.rand))
+		maxAmount = r.pairMaxAmount(fromChan, toChan, relFromAmount, relToAmount)
+		if amount != 0 {
+			maxAmount = min(maxAmount, amount)
+		}
+		// we need to also fail the route when maxAmount is zero
+		// this can happen when rapid-rebalancing.
+		if maxAmount < minAmount || maxAmount == 0 {
+			r.addFailedRoute(fromChan.ChanId, toChan.ChanId)
+			continue
+		}
+		r.expireFailedRoutes()
+		return fromChan.ChanId, toChan.ChanId, maxAmount, nil
+	}
+}
+
+// pairMaxAmount is how much can be moved between the channels, the relative
+// amounts also limit it by the desired balances of the channels
+func (r *Rebalancer) pairMaxAmount(fromChan, toChan *lnrpc.Channel, relFromAmount, relToAmount float64) int64 {
+	maxFrom := r.sendableMsat(fromChan) / 1000
+	if relFromAmount > 0 {
+		maxFrom = min(maxFrom, int64(float64(fromChan.Capacity)*relFromAmount)-fromChan.RemoteBalance)
+	}
+	maxTo := r.receivableMsat(toChan) / 1000
+	if relToAmount > 0 {
+		maxTo = min(maxTo, int64(float64(toChan.Capacity)*relToAmount)-toChan.LocalBalance)
+	}
+	return min(maxFrom, maxTo)
+}
+
+func (r *Rebalancer) expireFailedRoutes() {
+	r.pairs.expire(r.now())
+}
+
+// pickTarget picks a random target channel and returns all source channels
+// paired with it that can send the amount
+func (r *Rebalancer) pickTarget(amount, minAmount int64,
+	relFromAmount, relToAmount float64) (to uint64, sources []uint64, maxAmount int64, err error) {
+
+	for {
+		err = r.restoreFailedRoutes()
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		_, toChan := r.pairs.pair(r.pairs.pick(r.rand))
+		fromChans := r.pairs.sources(toChan.ChanId)
+		maxTo := r.receivableMsat(toChan) / 1000
+		if relToAmount > 0 {
+			maxTo = min(maxTo, int64(float64(toChan.Capacity)*relToAmount)-toChan.LocalBalance)
+		}
+		maxFrom := map[uint64]int64{}
+		bestFrom := int64(0)
+		for _, fromChan := range fromChans {
+			maxFrom[fromChan.ChanId] = r.sendableMsat(fromChan) / 1000
+			if relFromAmount > 0 {
+				maxFrom[fromChan.ChanId] = min(maxFrom[fromChan.ChanId],
+					int64(float64(fromChan.Capacity)*relFromAmount)-fromChan.RemoteBalance)
+			}
+			if maxFrom[fromChan.ChanId] > bestFrom {
+				bestFrom = maxFrom[fromChan.ChanId]
+			}
+		}
+		if amount == 0 {
+			maxAmount = min(bestFrom, maxTo)
+		} else {
+			maxAmount = min(bestFrom, maxTo, amount)
+		}
+		sources = nil
+		for _, fromChan := range fromChans {
+			if maxAmount < minAmount || maxAmount <= 0 || maxFrom[fromChan.ChanId] < minAmount {
+				r.addFailedRoute(fromChan.ChanId, toChan.ChanId)
+			} else if maxFrom[fromChan.ChanId] >= maxAmount {
+				// sources with less liquidity are skipped this time but can be
+				// used for other amounts later
+				sources = append(sources, fromChan.ChanId)
+			}
+		}
+		if len(sources) == 0 {
+			continue
+		}
+		r.expireFailedRoutes()
+		return toChan.ChanId, sources, maxAmount, nil
+	}
+}
+
+func (r *Rebalancer) addFailedRoute(from, to uint64) {
+	r.pairs.fail(from, to, r.now().Add(time.Minute*5))
+}
+
+func parseScid(chanId string) (int64, error) {
+
+	elements := strings.Split(strings.ToLower(chanId), "x")
+
+	blockHeight, err := strconv.ParseInt(elements[0], 10, 24)
+	if err != nil {
+		return 0, fmt.Errorf("not able to parse Blockheight of ShortChannelID %s, %s", chanId, err)
+	}
+	txIndex, err := strconv.ParseInt(elements[1], 10, 24)
+	if err != nil {
+		return 0, fmt.Errorf("not able to parse TxIndex of ShortChannelID %s, %s", chanId, err)
+
+	}
+	txPosition, err := strconv.ParseInt(elements[2], 10, 32)
+
+	if err != nil {
+		return 0, fmt.Errorf("not able to parse txPosition of ShortChannelID %s, %s", chanId, err)
+
+	}
+
+	var scId lnwire.ShortChannelID
+	scId.BlockHeight = uint32(blockHeight)
+	scId.TxIndex = uint32(txIndex)
+	scId.TxPosition = uint16(txPosition)
+
+	return int64(scId.ToUint64()), nil
+
+}
+
+func convertChanStringToInt(chanIds []string) (channels []uint64, err error) {
+
+	for _, cid := range chanIds {
+
+		chanId, err := strconv.ParseInt(cid, 10, 64)
+
+		if err != nil {
+
+			isScid := strings.Count(strings.ToLower(cid), "x") == 2
+			if !isScid {
+				return nil, fmt.Errorf("parsing Channel with Id %s, %s", cid, err)
+			}
+			chanId, err = parseScid(cid)
+			if err != nil {
+				return nil, err
+			}
+		}
+		channels = append(channels, uint64(chanId))
+
+	}
+
+	return channels, nil
+
+}
+
+func getChannelAge(chanId uint64) uint64 {
+	shortChanId := lnwire.NewShortChanIDFromInt(chanId)
+
+	return uint64(shortChanId.BlockHeight)
+}
+
+func (r *Rebalancer) getChannelForPeer(ctx context.Context, node []byte) ([]*lnrpc.Channel, error) {
+
+	channels, err := r.lnClient.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: true, Peer: node})
+
+	if err != nil {
+		return nil, fmt.Errorf("error fetching channels when filtering for node \"%x\": %s", node, err)
+	}
+
+	return channels.Channels, nil
+
+}
+
+func (r *Rebalancer) filterChannels(ctx context.Context, nodeChannelIDs []string) (channels map[uint64]struct{}, err error) {
+
+	channels = map[uint64]struct{}{}
+	chans, nodes, err := parseNodeChannelIDs(nodeChannelIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing node/channel list: %s", err)
+	}
+
+	for id := range chans {
+		if _, ok := channels[id]; !ok {
+			channels[id] = struct{}{}
+		}
+	}
+
+	for _, node := range nodes {
+		chans, err := r.getChannelForPeer(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range chans {
+			if _, ok := channels[c.ChanId]; !ok {
+				channels[c.ChanId] = struct{}{}
+			}
+		}
+	}
+
+	return
+
+}
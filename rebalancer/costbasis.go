@@ -0,0 +1,246 @@
+package rebalancer
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rkfg/regolancer/format"
+)
+
+type liquidityCost struct {
+	AmountMsat int64
+	CostMsat   int64
+}
+
+// costBasis tracks how much we paid for the liquidity that was pushed to our
+// channels by rebalancing and is still there
+type costBasis struct {
+	Channels map[uint64]*liquidityCost
+	// number of stat file records already accounted for
+	StatRecords int
+	// timestamp (ns) of the last forward accounted for
+	LastForward uint64
+}
+
+type liquidityEvent struct {
+	timestampNs uint64
+	chanIn      uint64
+	chanOut     uint64
+	amountMsat  int64
+	feeMsat     int64
+}
+
+func (c *liquidityCost) ppm() int64 {
+	if c.AmountMsat == 0 {
+		return 0
+	}
+	return c.CostMsat * 1e6 / c.AmountMsat
+}
+
+func (b *costBasis) add(chanId uint64, amountMsat, costMsat int64) {
+	c, ok := b.Channels[chanId]
+	if !ok {
+		c = &liquidityCost{}
+		b.Channels[chanId] = c
+	}
+	c.AmountMsat += amountMsat
+	c.CostMsat += costMsat
+}
+
+// remove takes the amount out at the current weighted cost, the liquidity
+// that wasn't bought by rebalancing is not tracked so we stop at zero
+func (b *costBasis) remove(chanId uint64, amountMsat int64) {
+	c, ok := b.Channels[chanId]
+	if !ok {
+		return
+	}
+	if amountMsat >= c.AmountMsat {
+		delete(b.Channels, chanId)
+		return
+	}
+	c.CostMsat -= c.CostMsat * amountMsat / c.AmountMsat
+	c.AmountMsat -= amountMsat
+}
+
+func readStatRecords(filename string) ([][]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	records := [][]string{}
+	header := true
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header {
+			header = false
+			continue
+		}
+		records = append(records, rec)
+	}
+}
+
+func parseStatRecord(rec []string) (e liquidityEvent, err error) {
+	if len(rec) < 5 {
+		return e, fmt.Errorf("invalid stat record %v", rec)
+	}
+	values := make([]int64, 5)
+	for i := range values {
+		values[i], err = strconv.ParseInt(rec[i], 10, 64)
+		if err != nil {
+			return e, fmt.Errorf("invalid stat record %v: %s", rec, err)
+		}
+	}
+	return liquidityEvent{timestampNs: uint64(values[0]) * 1e9, chanOut: uint64(values[1]), chanIn: uint64(values[2]),
+		amountMsat: values[3], feeMsat: values[4]}, nil
+}
+
+// updateCostBasis applies the new rebalances from the stat file and the new
+// forwards to the cost basis in chronological order
+func (r *Rebalancer) updateCostBasis(ctx context.Context, statFilename string) error {
+	records, err := readStatRecords(statFilename)
+	if err != nil {
+		return fmt.Errorf("error reading stat file: %s", err)
+	}
+	if len(records) < r.costBasis.StatRecords {
+		r.log(format.Info("Stat file is shorter than before, rebuilding liquidity cost basis"))
+		*r.costBasis = costBasis{Channels: map[uint64]*liquidityCost{}}
+	}
+	events := []liquidityEvent{}
+	for _, rec := range records[r.costBasis.StatRecords:] {
+		e, err := parseStatRecord(rec)
+		if err != nil {
+			return err
+		}
+		events = append(events, e)
+	}
+	if r.costBasis.LastForward == 0 {
+		if len(events) == 0 {
+			// nothing was bought yet so forwards don't matter
+			return nil
+		}
+		r.costBasis.LastForward = events[0].timestampNs
+	}
+	start := time.Unix(0, int64(r.costBasis.LastForward))
+	fwds, err := r.getForwards(ctx, start, r.now())
+	if err != nil {
+		return fmt.Errorf("error loading forwarding history: %s", err)
+	}
+	for _, f := range fwds {
+		if f.TimestampNs <= r.costBasis.LastForward {
+			continue
+		}
+		events = append(events, liquidityEvent{timestampNs: f.TimestampNs, chanOut: f.ChanIdOut,
+			amountMsat: int64(f.AmtOutMsat)})
+		r.costBasis.LastForward = f.TimestampNs
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].timestampNs < events[j].timestampNs
+	})
+	for _, e := range events {
+		r.costBasis.remove(e.chanOut, e.amountMsat)
+		if e.chanIn != 0 {
+			r.costBasis.add(e.chanIn, e.amountMsat, e.feeMsat)
+		}
+	}
+	r.costBasis.StatRecords = len(records)
+	return nil
+}
+
+// syncCostBasis loads the saved cost basis, applies the new stat records and
+// forwards to it and saves it back. The stat file is the source of truth
+// because other regolancer instances append to it too, the changes made in
+// memory during the session are replaced.
+func (r *Rebalancer) syncCostBasis(ctx context.Context) error {
+	err := r.loadCostBasis(r.opts.CostBasisFilename)
+	if err != nil {
+		r.errorf("Error loading cost basis, rebuilding: %s", err)
+		r.costBasis = &costBasis{Channels: map[uint64]*liquidityCost{}}
+	}
+	err = r.updateCostBasis(ctx, r.opts.StatFilename)
+	if err != nil {
+		return fmt.Errorf("error updating cost basis: %s", err)
+	}
+	err = r.saveCostBasis(r.opts.CostBasisFilename)
+	if err != nil {
+		r.errorf("Error saving cost basis: %s", err)
+	}
+	return nil
+}
+
+// addPayment applies the rebalance to the cost basis right away so that the
+// session sees the current cost, it's saved from the stat file later
+func (b *costBasis) addPayment(from, to uint64, amountMsat, feeMsat int64) {
+	b.remove(from, amountMsat)
+	b.add(to, amountMsat, feeMsat)
+}
+
+func (r *Rebalancer) loadCostBasis(filename string) error {
+	r.costBasis = &costBasis{Channels: map[uint64]*liquidityCost{}}
+	l := lock()
+	err := l.RLock()
+	defer l.Unlock()
+	if err != nil {
+		return fmt.Errorf("error taking shared lock on file %s: %s", filename, err)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("error opening cost basis file: %s", err)
+		}
+		return nil
+	}
+	defer f.Close()
+	return gob.NewDecoder(f).Decode(r.costBasis)
+}
+
+func (r *Rebalancer) saveCostBasis(filename string) error {
+	l := lock()
+	err := l.Lock()
+	defer l.Unlock()
+	if err != nil {
+		return fmt.Errorf("error taking exclusive lock on file %s: %s", filename, err)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating cost basis file: %s", err)
+	}
+	defer f.Close()
+	return gob.NewEncoder(f).Encode(r.costBasis)
+}
+
+// calcFeeGuardMsat limits the fee so that the rebalance ppm stays below the
+// current target channel fee minus the margin
+func (r *Rebalancer) calcFeeGuardMsat(ctx context.Context, to uint64, amtMsat int64, margin int64) (int64, error) {
+	cTo, err := r.getChanInfo(ctx, to)
+	if err != nil {
+		return 0, err
+	}
+	policyTo := cTo.Node2Policy
+	if cTo.Node1Pub == r.myPK {
+		policyTo = cTo.Node1Policy
+	}
+	feeMsat := amtMsat * (policyTo.FeeRateMilliMsat - margin) / 1e6
+	if feeMsat < 0 {
+		return 0, fmt.Errorf("target channel fee %d ppm is below the fee guard margin %d ppm",
+			policyTo.FeeRateMilliMsat, margin)
+	}
+	return feeMsat, nil
+}
@@ -0,0 +1,73 @@
+package rebalancer
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rkfg/regolancer/format"
+)
+
+func (r *Rebalancer) setupDrain(chanIdStr string, threshold float64, feeBudget int64) error {
+	chanIds, err := convertChanStringToInt([]string{chanIdStr})
+	if err != nil {
+		return err
+	}
+	c := r.findChannel(chanIds[0])
+	if c == nil {
+		return fmt.Errorf("channel %d not found or inactive", chanIds[0])
+	}
+	// the drained channel might be excluded in the config to protect it from
+	// being used as a source in the regular rebalances, ignore that
+	delete(r.excludeFrom, c.ChanId)
+	delete(r.excludeBoth, c.ChanId)
+	return r.startGoal(c, threshold/100, false, feeBudget)
+}
+
+// CloseDrainedChannel cooperatively closes the channel drained in this session
+// and returns the closing transaction id
+func (r *Rebalancer) CloseDrainedChannel(ctx context.Context, satPerVbyte uint64) (string, error) {
+	if r.goal == nil || r.opts.Drain == "" {
+		return "", fmt.Errorf("no channel is being drained")
+	}
+	c := r.findChannel(r.goal.chanId)
+	if c == nil {
+		return "", fmt.Errorf("channel %d not found or inactive", r.goal.chanId)
+	}
+	chanPoint := strings.Split(c.ChannelPoint, ":")
+	if len(chanPoint) != 2 {
+		return "", fmt.Errorf("invalid channel point %s", c.ChannelPoint)
+	}
+	outputIndex, err := strconv.ParseUint(chanPoint[1], 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid channel point %s: %s", c.ChannelPoint, err)
+	}
+	r.logf("Closing channel %s cooperatively", format.HiWhite(c.ChannelPoint))
+	stream, err := r.lnClient.CloseChannel(ctx, &lnrpc.CloseChannelRequest{
+		ChannelPoint: &lnrpc.ChannelPoint{
+			FundingTxid: &lnrpc.ChannelPoint_FundingTxidStr{FundingTxidStr: chanPoint[0]},
+			OutputIndex: uint32(outputIndex),
+		},
+		SatPerVbyte: satPerVbyte,
+	})
+	if err != nil {
+		return "", err
+	}
+	update, err := stream.Recv()
+	if err != nil {
+		return "", err
+	}
+	pending := update.GetClosePending()
+	if pending == nil {
+		return "", fmt.Errorf("unexpected close update %v", update)
+	}
+	txid := make([]byte, len(pending.Txid))
+	// txid bytes are in the internal order, reverse them to display
+	for i := range pending.Txid {
+		txid[i] = pending.Txid[len(pending.Txid)-1-i]
+	}
+	return hex.EncodeToString(txid), nil
+}
@@ -0,0 +1,189 @@
+package rebalancer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RoutingPolicy fields of the inbound fee added in lnd 0.18, the lnrpc version
+// we build against doesn't know them so they're kept in the unknown fields of
+// the message
+const (
+	inboundFeeBaseField protowire.Number = 9
+	inboundFeeRateField protowire.Number = 10
+)
+
+// InboundFee is the fee the node charges for the HTLCs coming to it through
+// the channel, it's usually negative (a discount)
+type InboundFee struct {
+	BaseMsat      int64
+	RateMilliMsat int64
+}
+
+// GetInboundFee returns the inbound fee of the policy, it's zero if lnd
+// doesn't support inbound fees or the node hasn't set them
+func GetInboundFee(policy *lnrpc.RoutingPolicy) (fee InboundFee) {
+	if policy == nil {
+		return
+	}
+	b := policy.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return InboundFee{}
+		}
+		b = b[n:]
+		if typ == protowire.VarintType && (num == inboundFeeBaseField || num == inboundFeeRateField) {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return InboundFee{}
+			}
+			b = b[n:]
+			// int32 fields are sign extended to 64 bits
+			if num == inboundFeeBaseField {
+				fee.BaseMsat = int64(int32(v))
+			} else {
+				fee.RateMilliMsat = int64(int32(v))
+			}
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return InboundFee{}
+		}
+		b = b[n:]
+	}
+	return
+}
+
+// SetInboundFee stores the inbound fee in the policy the way lnd sends it
+func SetInboundFee(policy *lnrpc.RoutingPolicy, fee InboundFee) {
+	if policy == nil {
+		return
+	}
+	var result []byte
+	b := policy.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			break
+		}
+		l := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if l < 0 {
+			break
+		}
+		if num != inboundFeeBaseField && num != inboundFeeRateField {
+			result = append(result, b[:n+l]...)
+		}
+		b = b[n+l:]
+	}
+	if fee.BaseMsat != 0 {
+		result = protowire.AppendTag(result, inboundFeeBaseField, protowire.VarintType)
+		result = protowire.AppendVarint(result, uint64(fee.BaseMsat))
+	}
+	if fee.RateMilliMsat != 0 {
+		result = protowire.AppendTag(result, inboundFeeRateField, protowire.VarintType)
+		result = protowire.AppendVarint(result, uint64(fee.RateMilliMsat))
+	}
+	policy.ProtoReflect().SetUnknown(result)
+}
+
+// FeeMsat returns the inbound fee for the amount
+func (f InboundFee) FeeMsat(amtMsat int64) int64 {
+	return f.BaseMsat + amtMsat*f.RateMilliMsat/1e6
+}
+
+// PolicyFeeMsat returns the outbound fee the policy sets for forwarding the
+// amount, it's calculated the same way lnd does it
+func PolicyFeeMsat(policy *lnrpc.RoutingPolicy, amtMsat int64) int64 {
+	if policy == nil {
+		return 0
+	}
+	return policy.FeeBaseMsat + amtMsat*policy.FeeRateMilliMsat/1e6
+}
+
+// ForwardFeeMsat returns the fee a node charges for forwarding the amount from
+// the incoming channel to the outgoing one: the outbound fee of the outgoing
+// channel policy plus the inbound fee of the incoming channel policy (both set
+// by this node) for the amount with the outbound fee, lnd doesn't let the
+// total go below zero
+func ForwardFeeMsat(inPolicy, outPolicy *lnrpc.RoutingPolicy, amtMsat int64) int64 {
+	outFeeMsat := PolicyFeeMsat(outPolicy, amtMsat)
+	feeMsat := outFeeMsat + GetInboundFee(inPolicy).FeeMsat(amtMsat+outFeeMsat)
+	if feeMsat < 0 {
+		return 0
+	}
+	return feeMsat
+}
+
+type jsonInboundFee struct {
+	BaseMsat      *int64 `json:"inbound_fee_base_msat"`
+	RateMilliMsat *int64 `json:"inbound_fee_rate_milli_msat"`
+	// protojson accepts the camel case names too
+	BaseMsatCamel      *int64 `json:"inboundFeeBaseMsat"`
+	RateMilliMsatCamel *int64 `json:"inboundFeeRateMilliMsat"`
+}
+
+func (f *jsonInboundFee) fee() (result InboundFee) {
+	if f == nil {
+		return
+	}
+	for _, v := range []*int64{f.BaseMsat, f.BaseMsatCamel} {
+		if v != nil {
+			result.BaseMsat = *v
+		}
+	}
+	for _, v := range []*int64{f.RateMilliMsat, f.RateMilliMsatCamel} {
+		if v != nil {
+			result.RateMilliMsat = *v
+		}
+	}
+	return
+}
+
+// ParseGraph parses the lncli describegraph JSON output keeping the inbound
+// fees that the lnrpc version we use doesn't know about
+func ParseGraph(data []byte) (*lnrpc.ChannelGraph, error) {
+	graph := &lnrpc.ChannelGraph{}
+	err := protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, graph)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing graph: %s", err)
+	}
+	var inbound struct {
+		Edges []struct {
+			Node1Policy      *jsonInboundFee `json:"node1_policy"`
+			Node2Policy      *jsonInboundFee `json:"node2_policy"`
+			Node1PolicyCamel *jsonInboundFee `json:"node1Policy"`
+			Node2PolicyCamel *jsonInboundFee `json:"node2Policy"`
+		} `json:"edges"`
+	}
+	err = json.Unmarshal(data, &inbound)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing inbound fees: %s", err)
+	}
+	if len(inbound.Edges) != len(graph.Edges) {
+		return nil, fmt.Errorf("error parsing inbound fees: edge count mismatch")
+	}
+	for i, e := range inbound.Edges {
+		for _, p := range []struct {
+			policy     *lnrpc.RoutingPolicy
+			snake, cam *jsonInboundFee
+		}{
+			{graph.Edges[i].Node1Policy, e.Node1Policy, e.Node1PolicyCamel},
+			{graph.Edges[i].Node2Policy, e.Node2Policy, e.Node2PolicyCamel},
+		} {
+			fee := p.snake.fee()
+			if p.snake == nil {
+				fee = p.cam.fee()
+			}
+			if fee != (InboundFee{}) {
+				SetInboundFee(p.policy, fee)
+			}
+		}
+	}
+	return graph, nil
+}
@@ -0,0 +1,82 @@
+package rebalancer
+
+import (
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestInboundFeeRoundTrip(t *testing.T) {
+	policy := &lnrpc.RoutingPolicy{FeeBaseMsat: 1000, FeeRateMilliMsat: 500}
+	fee := InboundFee{BaseMsat: -200, RateMilliMsat: -100}
+	SetInboundFee(policy, fee)
+	data, err := proto.Marshal(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &lnrpc.RoutingPolicy{}
+	if err := proto.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetInboundFee(decoded); got != fee {
+		t.Fatalf("got %+v, expected %+v", got, fee)
+	}
+	SetInboundFee(decoded, InboundFee{RateMilliMsat: 50})
+	if got := GetInboundFee(decoded); got != (InboundFee{RateMilliMsat: 50}) {
+		t.Fatalf("fee not replaced: %+v", got)
+	}
+}
+
+func TestForwardFeeMsat(t *testing.T) {
+	out := &lnrpc.RoutingPolicy{FeeBaseMsat: 1000, FeeRateMilliMsat: 500}
+	in := &lnrpc.RoutingPolicy{}
+	tests := []struct {
+		name    string
+		inbound InboundFee
+		amtMsat int64
+		feeMsat int64
+	}{
+		{"no inbound fee", InboundFee{}, 1_000_000_000, 501_000},
+		{"discount", InboundFee{BaseMsat: -1000, RateMilliMsat: -100}, 1_000_000_000, 399_950},
+		{"surcharge", InboundFee{RateMilliMsat: 100}, 1_000_000_000, 601_050},
+		{"never negative", InboundFee{RateMilliMsat: -1000}, 1_000_000_000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetInboundFee(in, tt.inbound)
+			if got := ForwardFeeMsat(in, out, tt.amtMsat); got != tt.feeMsat {
+				t.Fatalf("got %d, expected %d", got, tt.feeMsat)
+			}
+		})
+	}
+}
+
+func TestPolicyFeeMsat(t *testing.T) {
+	// the base fee is in msat and isn't scaled by the amount
+	policy := &lnrpc.RoutingPolicy{FeeBaseMsat: 1000, FeeRateMilliMsat: 100}
+	if got := PolicyFeeMsat(policy, 1_000_000_000); got != 101_000 {
+		t.Fatalf("got %d, expected 101000", got)
+	}
+	if got := PolicyFeeMsat(&lnrpc.RoutingPolicy{FeeBaseMsat: 1000}, 1_000_000_000); got != 1000 {
+		t.Fatalf("got %d, expected the base fee 1000", got)
+	}
+}
+
+func TestParseGraphInboundFees(t *testing.T) {
+	graph, err := ParseGraph([]byte(`{"nodes": [], "edges": [{"channel_id": "1", "node1_pub": "a", "node2_pub": "b",
+		"node1_policy": {"fee_base_msat": "1000", "inbound_fee_base_msat": -10, "inbound_fee_rate_milli_msat": -20},
+		"node2_policy": {"fee_rate_milli_msat": "1"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := GetInboundFee(graph.Edges[0].Node1Policy); got != (InboundFee{BaseMsat: -10, RateMilliMsat: -20}) {
+		t.Fatalf("node1 inbound fee %+v", got)
+	}
+	if got := GetInboundFee(graph.Edges[0].Node2Policy); got != (InboundFee{}) {
+		t.Fatalf("node2 inbound fee %+v", got)
+	}
+	if graph.Edges[0].Node1Policy.FeeBaseMsat != 1000 {
+		t.Fatalf("outbound fee not parsed")
+	}
+}
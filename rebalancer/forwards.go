@@ -0,0 +1,95 @@
+package rebalancer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+type forwardStat struct {
+	amtOutMsat int64
+	feeMsat    int64
+}
+
+func (r *Rebalancer) getForwards(ctx context.Context, start, end time.Time) ([]*lnrpc.ForwardingEvent, error) {
+	result := []*lnrpc.ForwardingEvent{}
+	offset := uint32(0)
+	for {
+		fwds, err := r.lnClient.ForwardingHistory(ctx, &lnrpc.ForwardingHistoryRequest{
+			StartTime:    uint64(start.Unix()),
+			EndTime:      uint64(end.Unix()),
+			IndexOffset:  offset,
+			NumMaxEvents: 50000,
+		})
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, fwds.ForwardingEvents...)
+		if len(fwds.ForwardingEvents) == 0 || fwds.LastOffsetIndex == offset {
+			return result, nil
+		}
+		offset = fwds.LastOffsetIndex
+	}
+}
+
+// loadForwardStats sums up the outgoing forwards and fees earned for every
+// channel in the last days, the channels that forwarded less than minVolume
+// sats are excluded from targets if excludeInactive is set
+func (r *Rebalancer) loadForwardStats(ctx context.Context, days int, minVolume int64, excludeInactive bool) error {
+	fwds, err := r.getForwards(ctx, r.now().AddDate(0, 0, -days), r.now())
+	if err != nil {
+		return err
+	}
+	r.forwardStats = map[uint64]forwardStat{}
+	for _, f := range fwds {
+		s := r.forwardStats[f.ChanIdOut]
+		s.amtOutMsat += int64(f.AmtOutMsat)
+		s.feeMsat += int64(f.FeeMsat)
+		r.forwardStats[f.ChanIdOut] = s
+	}
+	for _, c := range r.channels {
+		if r.forwardStats[c.ChanId].amtOutMsat > 0 && r.forwardStats[c.ChanId].amtOutMsat >= minVolume*1000 {
+			continue
+		}
+		delete(r.forwardStats, c.ChanId)
+		if excludeInactive {
+			r.excludeTo[c.ChanId] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (r *Rebalancer) calcForwardsFeeMsat(ctx context.Context, from, to uint64, amtMsat int64) (feeMsat int64,
+	lastPKstr string, err error) {
+	cTo, err := r.getChanInfo(ctx, to)
+	if err != nil {
+		return 0, "", err
+	}
+	lastPKstr = cTo.Node1Pub
+	if lastPKstr == r.myPK {
+		lastPKstr = cTo.Node2Pub
+	}
+	var ppm int64
+	if s, ok := r.forwardStats[to]; ok {
+		ppm = int64(float64(s.feeMsat) / float64(s.amtOutMsat) * 1e6 * r.opts.EconRatio)
+		if ppm < r.opts.EconForwardsMinPPM {
+			ppm = r.opts.EconForwardsMinPPM
+		}
+		if r.opts.EconRatioMaxPPM != 0 && ppm > r.opts.EconRatioMaxPPM {
+			ppm = r.opts.EconRatioMaxPPM
+		}
+	} else {
+		ppm = r.opts.EconForwardsNoHistoryPPM
+	}
+	lostProfitMsat, err := r.calcLostProfitMsat(ctx, from, to, amtMsat)
+	if err != nil {
+		return 0, "", err
+	}
+	feeMsat = amtMsat*ppm/1e6 - lostProfitMsat
+	if feeMsat < 0 {
+		return 0, "", fmt.Errorf("max fee less than zero")
+	}
+	return
+}
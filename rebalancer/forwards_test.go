@@ -0,0 +1,113 @@
+package rebalancer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+)
+
+const (
+	testPK     = "02aaaa"
+	testPeerPK = "02bbbb"
+)
+
+// forwardsClient returns the forwarding history in one page
+type forwardsClient struct {
+	lnrpc.LightningClient
+	events []*lnrpc.ForwardingEvent
+}
+
+func (c *forwardsClient) ForwardingHistory(ctx context.Context, in *lnrpc.ForwardingHistoryRequest,
+	opts ...grpc.CallOption) (*lnrpc.ForwardingHistoryResponse, error) {
+	if in.IndexOffset > 0 {
+		return &lnrpc.ForwardingHistoryResponse{LastOffsetIndex: in.IndexOffset}, nil
+	}
+	return &lnrpc.ForwardingHistoryResponse{ForwardingEvents: c.events, LastOffsetIndex: uint32(len(c.events))}, nil
+}
+
+func forwardsRebalancer(events []*lnrpc.ForwardingEvent, chanIds ...uint64) *Rebalancer {
+	r := &Rebalancer{
+		lnClient:  &forwardsClient{events: events},
+		myPK:      testPK,
+		chanCache: map[uint64]cachedChanInfo{},
+		excludeTo: map[uint64]struct{}{},
+	}
+	for _, id := range chanIds {
+		r.channels = append(r.channels, &lnrpc.Channel{ChanId: id, RemotePubkey: testPeerPK})
+		r.chanCache[id] = newCachedChanInfo(&lnrpc.ChannelEdge{ChannelId: id, Node1Pub: testPK, Node2Pub: testPeerPK,
+			Node1Policy: &lnrpc.RoutingPolicy{}, Node2Policy: &lnrpc.RoutingPolicy{}}, time.Now())
+	}
+	return r
+}
+
+func TestCalcForwardsFeeMsat(t *testing.T) {
+	// channel 1 earned 500 ppm, channel 2 has no history
+	r := forwardsRebalancer(nil, 1, 2)
+	r.forwardStats = map[uint64]forwardStat{1: {amtOutMsat: 2_000_000_000, feeMsat: 1_000_000}}
+	tests := []struct {
+		name      string
+		to        uint64
+		ratio     float64
+		minPPM    int64
+		maxPPM    int64
+		noHistory int64
+		feeMsat   int64
+	}{
+		{name: "realized ppm", to: 1, ratio: 0.5, feeMsat: 250_000},
+		{name: "min ppm floor", to: 1, ratio: 0.5, minPPM: 300, feeMsat: 300_000},
+		{name: "max ppm ceiling", to: 1, ratio: 1, maxPPM: 200, feeMsat: 200_000},
+		{name: "no history", to: 2, ratio: 1, minPPM: 300, noHistory: 100, feeMsat: 100_000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.opts = Options{EconRatio: tt.ratio, EconForwardsMinPPM: tt.minPPM, EconRatioMaxPPM: tt.maxPPM,
+				EconForwardsNoHistoryPPM: tt.noHistory, ChanCacheLifetime: 60}
+			feeMsat, lastPK, err := r.calcForwardsFeeMsat(context.Background(), 0, tt.to, 1_000_000_000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if feeMsat != tt.feeMsat || lastPK != testPeerPK {
+				t.Fatalf("fee %d msat, last hop %s, expected %d msat", feeMsat, lastPK, tt.feeMsat)
+			}
+		})
+	}
+}
+
+func TestLoadForwardStats(t *testing.T) {
+	events := []*lnrpc.ForwardingEvent{
+		{ChanIdOut: 1, AmtOutMsat: 3_000_000_000, FeeMsat: 3_000_000},
+		{ChanIdOut: 2, AmtOutMsat: 500_000_000, FeeMsat: 1_000_000},
+	}
+	tests := []struct {
+		name            string
+		excludeInactive bool
+		excluded        []uint64
+	}{
+		// channel 2 forwarded less than the min volume, channel 3 nothing
+		{name: "no history ppm set", excludeInactive: false},
+		{name: "no history ppm not set", excludeInactive: true, excluded: []uint64{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := forwardsRebalancer(events, 1, 2, 3)
+			err := r.loadForwardStats(context.Background(), 30, 1_000_000, tt.excludeInactive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.forwardStats) != 1 || r.forwardStats[1].feeMsat != 3_000_000 {
+				t.Fatalf("unexpected stats %+v", r.forwardStats)
+			}
+			if len(r.excludeTo) != len(tt.excluded) {
+				t.Fatalf("excluded %v, expected %v", r.excludeTo, tt.excluded)
+			}
+			for _, id := range tt.excluded {
+				if _, ok := r.excludeTo[id]; !ok {
+					t.Fatalf("channel %d is not excluded", id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package rebalancer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rkfg/regolancer/format"
+)
+
+type rebalanceGoal struct {
+	chanId        uint64
+	ratio         float64
+	refill        bool
+	feeBudgetMsat int64
+	reached       bool
+	fromChannelId map[uint64]struct{}
+	toChannelId   map[uint64]struct{}
+}
+
+func parseGoal(goal string) (chanId uint64, ratio float64, err error) {
+	parts := strings.Split(goal, "=")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid goal %s, expected CHANNEL=PERCENT%%", goal)
+	}
+	chanIds, err := convertChanStringToInt([]string{parts[0]})
+	if err != nil {
+		return 0, 0, err
+	}
+	chanId = chanIds[0]
+	perc, err := strconv.ParseFloat(strings.TrimSuffix(parts[1], "%"), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid goal percentage %s: %s", parts[1], err)
+	}
+	if perc <= 0 || perc >= 100 {
+		return 0, 0, fmt.Errorf("goal percentage should be between 0 and 100, got %s", parts[1])
+	}
+	return chanId, perc / 100, nil
+}
+
+func copyChanSet(set map[uint64]struct{}) map[uint64]struct{} {
+	if set == nil {
+		return nil
+	}
+	result := map[uint64]struct{}{}
+	for k := range set {
+		result[k] = struct{}{}
+	}
+	return result
+}
+
+func (r *Rebalancer) findChannel(chanId uint64) *lnrpc.Channel {
+	for _, c := range r.channels {
+		if c.ChanId == chanId {
+			return c
+		}
+	}
+	return nil
+}
+
+// goalRemaining returns how many sats still need to be moved to reach the goal
+func (r *Rebalancer) goalRemaining(c *lnrpc.Channel) int64 {
+	goalBalance := int64(float64(c.Capacity) * r.goal.ratio)
+	if r.goal.refill {
+		return goalBalance - c.LocalBalance
+	}
+	return c.LocalBalance - goalBalance
+}
+
+func (r *Rebalancer) setupGoal(goal string, feeBudget int64) error {
+	chanId, ratio, err := parseGoal(goal)
+	if err != nil {
+		return err
+	}
+	c := r.findChannel(chanId)
+	if c == nil {
+		return fmt.Errorf("goal channel %d not found or inactive", chanId)
+	}
+	return r.startGoal(c, ratio, float64(c.LocalBalance)/float64(c.Capacity) < ratio, feeBudget)
+}
+
+func (r *Rebalancer) startGoal(c *lnrpc.Channel, ratio float64, refill bool, feeBudget int64) error {
+	r.goal = &rebalanceGoal{chanId: c.ChanId, ratio: ratio, refill: refill, feeBudgetMsat: feeBudget * 1000}
+	if r.goalRemaining(c) <= 0 {
+		return fmt.Errorf("channel %d is already at %d%% local balance", c.ChanId, c.LocalBalance*100/c.Capacity)
+	}
+	// the goal channel is the only target when refilling and the only source
+	// when draining, the counterparts are selected as usual
+	if refill {
+		if len(r.toChannelId) > 0 {
+			return fmt.Errorf("can't select target channels when refilling a channel in goal mode")
+		}
+		r.toChannelId = makeChanSet([]uint64{c.ChanId})
+		r.opts.ToPerc = int64(math.Ceil(ratio * 100))
+		r.opts.RelAmountTo = ratio
+	} else {
+		if len(r.fromChannelId) > 0 {
+			return fmt.Errorf("can't select source channels when draining a channel in goal mode")
+		}
+		r.fromChannelId = makeChanSet([]uint64{c.ChanId})
+		r.opts.FromPerc = int64(math.Ceil((1 - ratio) * 100))
+		r.opts.RelAmountFrom = 1 - ratio
+	}
+	r.goal.fromChannelId = copyChanSet(r.fromChannelId)
+	r.goal.toChannelId = copyChanSet(r.toChannelId)
+	return nil
+}
+
+// checkGoal refreshes the channel balances and reports if the goal is
+// reached or the fee budget is exhausted, otherwise the channel candidates are
+// recalculated for the next rebalance
+func (r *Rebalancer) checkGoal(ctx context.Context) (done bool, err error) {
+	err = r.getChannels(ctx)
+	if err != nil {
+		return false, err
+	}
+	c := r.findChannel(r.goal.chanId)
+	if c == nil {
+		return false, fmt.Errorf("goal channel %d not found or inactive", r.goal.chanId)
+	}
+	r.logf("Goal channel local balance is %s%% (goal is %s%%), moved %s sat so far, paid %s sat in fees",
+		format.HiWhite(c.LocalBalance*100/c.Capacity), format.HiWhite(int64(r.goal.ratio*100)),
+		format.Amt(r.successfulAmt), format.Fee(r.paidFeesMsat))
+	remaining := r.goalRemaining(c)
+	if remaining <= 0 || remaining < r.opts.MinAmount {
+		r.log(format.Info("Goal reached"))
+		r.goal.reached = true
+		return true, nil
+	}
+	if r.goal.feeBudgetMsat > 0 && r.paidFeesMsat >= r.goal.feeBudgetMsat {
+		r.log(format.Info("Goal fee budget exhausted"))
+		return true, nil
+	}
+	return false, r.refreshCandidates(r.goal.fromChannelId, r.goal.toChannelId)
+}
+
+// refreshCandidates selects the channel candidates again from the refreshed
+// channels, the failed pairs are kept
+func (r *Rebalancer) refreshCandidates(fromChannelId, toChannelId map[uint64]struct{}) error {
+	r.fromChannelId = copyChanSet(fromChannelId)
+	r.toChannelId = copyChanSet(toChannelId)
+	r.fromChannels = nil
+	r.toChannels = nil
+	oldPairs := r.pairs
+	err := r.getChannelCandidates(r.opts.FromPerc, r.opts.ToPerc, r.opts.Amount)
+	if err != nil {
+		return err
+	}
+	r.pairs.inheritFailures(oldPairs)
+	return nil
+}
+
+// goalFeeLimitMsat caps the fee for a single payment by the unspent fee budget
+func (r *Rebalancer) goalFeeLimitMsat(feeMsat int64) int64 {
+	if r.goal == nil || r.goal.feeBudgetMsat == 0 {
+		return feeMsat
+	}
+	return min(feeMsat, r.goal.feeBudgetMsat-r.paidFeesMsat)
+}
@@ -1,4 +1,4 @@
-package main
+package rebalancer
 
 func absoluteDeltaPPM(base, amt int64) (deltaPPM int64) {
 
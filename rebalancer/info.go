@@ -0,0 +1,96 @@
+package rebalancer
+
+import (
+	"context"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// ChannelInfo is our channel with the peer alias
+type ChannelInfo struct {
+	*lnrpc.Channel
+	Alias string
+}
+
+// ChannelCost is the cost of the liquidity bought by rebalancing that's still
+// in the channel
+type ChannelCost struct {
+	ChannelInfo
+	AmountMsat int64
+	CostPPM    int64
+}
+
+// GoalInfo describes the goal mode setup, Ratio is the local balance fraction
+// to reach
+type GoalInfo struct {
+	ChanId        uint64
+	Ratio         float64
+	Refill        bool
+	FeeBudgetMsat int64
+}
+
+// Info describes the rebalance session setup
+type Info struct {
+	From []ChannelInfo
+	To   []ChannelInfo
+	// CostBasis is only filled if the cost basis tracking is enabled
+	CostBasis     []ChannelCost
+	Goal          *GoalInfo
+	NodeCacheSize int
+	// Options are the effective options with the defaults applied and the
+	// goal mode changes
+	Options Options
+}
+
+func (r *Rebalancer) channelInfo(ctx context.Context, channel *lnrpc.Channel) (ChannelInfo, error) {
+	nodeInfo, err := r.getNodeInfo(ctx, channel.RemotePubkey)
+	if err != nil {
+		return ChannelInfo{}, err
+	}
+	return ChannelInfo{Channel: channel, Alias: nodeInfo.Node.Alias}, nil
+}
+
+func (r *Rebalancer) channelInfos(ctx context.Context, channels []*lnrpc.Channel) ([]ChannelInfo, error) {
+	result := []ChannelInfo{}
+	for _, c := range channels {
+		info, err := r.channelInfo(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// Info returns the selected channels and other rebalance session information
+func (r *Rebalancer) Info(ctx context.Context) (result *Info, err error) {
+	result = &Info{NodeCacheSize: len(r.nodeCache), Options: r.opts}
+	result.From, err = r.channelInfos(ctx, r.fromChannels)
+	if err != nil {
+		return nil, err
+	}
+	result.To, err = r.channelInfos(ctx, r.toChannels)
+	if err != nil {
+		return nil, err
+	}
+	if r.costBasis != nil {
+		result.CostBasis = []ChannelCost{}
+		for _, c := range r.channels {
+			basis, ok := r.costBasis.Channels[c.ChanId]
+			if !ok {
+				continue
+			}
+			info, err := r.channelInfo(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			result.CostBasis = append(result.CostBasis, ChannelCost{ChannelInfo: info, AmountMsat: basis.AmountMsat,
+				CostPPM: basis.ppm()})
+		}
+	}
+	if r.goal != nil {
+		result.Goal = &GoalInfo{ChanId: r.goal.chanId, Ratio: r.goal.ratio, Refill: r.goal.refill,
+			FeeBudgetMsat: r.goal.feeBudgetMsat}
+	}
+	return result, nil
+}
@@ -1,4 +1,4 @@
-package main
+package rebalancer
 
 import (
 	"context"
@@ -9,15 +9,31 @@ import (
 	"github.com/lightningnetwork/lnd/lnrpc"
 )
 
-func (r *regolancer) addFailedChan(fromStr string, toStr string, amount int64) {
+// addFailedChan saves the amount that couldn't be forwarded between the nodes,
+// it's the upper bound of the liquidity so only the smallest one is kept
+func (r *Rebalancer) addFailedChan(fromStr string, toStr string, amount int64) {
+	if fp, ok := r.mcCache[fromStr+toStr]; ok && fp <= amount {
+		return
+	}
 	r.mcCache[fromStr+toStr] = amount
 }
 
-func (r *regolancer) validateRoute(route *lnrpc.Route) error {
+// addRouteFailure saves the liquidity bound of the hop that reported the
+// temporary channel failure
+func (r *Rebalancer) addRouteFailure(route *lnrpc.Route, failure *lnrpc.Failure) {
+	idx := int(failure.FailureSourceIndex)
+	if failure.Code != lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE || idx == 0 || idx >= len(route.Hops) {
+		return
+	}
+	r.addFailedChan(route.Hops[idx-1].PubKey, route.Hops[idx].PubKey, route.Hops[idx-1].AmtToForwardMsat)
+}
+
+func (r *Rebalancer) validateRoute(route *lnrpc.Route) error {
 	prevHopPK := r.myPK
 	for _, h := range route.Hops {
 		hopPK := h.PubKey
-		if fp, ok := r.mcCache[prevHopPK+hopPK]; ok && absoluteDeltaPPM(fp, h.AmtToForwardMsat) < params.FailTolerance {
+		if fp, ok := r.mcCache[prevHopPK+hopPK]; ok && (h.AmtToForwardMsat >= fp ||
+			absoluteDeltaPPM(fp, h.AmtToForwardMsat) < r.opts.FailTolerance) {
 			from, err := hex.DecodeString(prevHopPK)
 			if err != nil {
 				return err
@@ -34,7 +50,7 @@ func (r *regolancer) validateRoute(route *lnrpc.Route) error {
 	return nil
 }
 
-func (r *regolancer) maxAmountOnRoute(ctx context.Context, route *lnrpc.Route) (uint64, error) {
+func (r *Rebalancer) maxAmountOnRoute(ctx context.Context, route *lnrpc.Route) (uint64, error) {
 	var capAmountMsat uint64 = math.MaxInt64
 	for _, h := range route.Hops {
 		edge, err := r.getChanInfo(ctx, h.ChanId)
@@ -0,0 +1,160 @@
+package rebalancer
+
+import (
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/walletrpc"
+)
+
+// Options mirror the regolancer command line parameters, see its help for the
+// details. Channels and nodes are specified as channel IDs (numeric or
+// BLOCKxTXxOUT) or node pubkeys. Zero percentages, fail tolerance, node cache
+// lifetime and timeouts are replaced by the defaults.
+type Options struct {
+	FromPerc            int64
+	ToPerc              int64
+	Amount              int64
+	RelAmountTo         float64
+	RelAmountFrom       float64
+	MinAmount           int64
+	ProbeSteps          int
+	ProbeParallel       int
+	TargetFirst         bool
+	AllowRapidRebalance bool
+	// RapidStrategy is one of the RapidStrategy* constants, double by default
+	RapidStrategy            string
+	From                     []string
+	To                       []string
+	ExcludeFrom              []string
+	ExcludeTo                []string
+	Exclude                  []string
+	ExcludeChannelAge        uint64
+	FailTolerance            int64
+	EconRatio                float64
+	EconRatioMaxPPM          int64
+	EconForwardsDays         int
+	EconForwardsMinPPM       int64
+	EconForwardsMinVolume    int64
+	EconForwardsNoHistoryPPM int64
+	FeeLimitPPM              int64
+	LostProfit               bool
+	// TotalAmount and MaxRebalances make the session continue after a
+	// successful rebalance until the total amount is moved or this many
+	// rebalances succeed
+	TotalAmount   int64
+	MaxRebalances int
+	// Goal is CHANNEL=PERCENT%
+	Goal          string
+	GoalFeeBudget int64
+	// Drain is the channel to drain down to DrainThreshold percent of local
+	// balance, GoalFeeBudget applies too
+	Drain             string
+	DrainThreshold    float64
+	LoopOutFallback   bool
+	LoopOutMaxPPM     int64
+	CostBasisFilename string
+	FeeGuard          bool
+	FeeGuardMargin    int64
+	NodeCacheFilename string
+	// node cache lifetime in minutes
+	NodeCacheLifetime int
+	ChanCacheFilename string
+	// channel cache lifetime in minutes, the edges with recently updated
+	// policies expire sooner
+	ChanCacheLifetime int
+	// TimeoutRebalance and TimeoutAttempt are in minutes, TimeoutInfo and
+	// TimeoutRoute in seconds
+	TimeoutRebalance int
+	TimeoutAttempt   int
+	TimeoutInfo      int
+	TimeoutRoute     int
+	StatFilename     string
+	// Seed makes the random channel pair selection reproducible, a random
+	// seed is used if it's zero
+	Seed int64
+	// Now replaces the wall clock for the failed pair and cache expiration,
+	// it's used to replay the recorded sessions
+	Now func() time.Time
+}
+
+func (o *Options) setDefaults() {
+	if o.FromPerc == 0 {
+		o.FromPerc = 50
+	}
+	if o.ToPerc == 0 {
+		o.ToPerc = 50
+	}
+	if o.FailTolerance == 0 {
+		o.FailTolerance = 1000
+	}
+	if o.NodeCacheLifetime == 0 {
+		o.NodeCacheLifetime = 1440
+	}
+	if o.ChanCacheLifetime == 0 {
+		o.ChanCacheLifetime = 1440
+	}
+	if o.TimeoutAttempt == 0 {
+		o.TimeoutAttempt = 5
+	}
+	if o.TimeoutRebalance == 0 {
+		o.TimeoutRebalance = 360
+	}
+	if o.TimeoutInfo == 0 {
+		o.TimeoutInfo = 30
+	}
+	if o.TimeoutRoute == 0 {
+		o.TimeoutRoute = 30
+	}
+	if o.RapidStrategy == "" {
+		o.RapidStrategy = RapidStrategyDouble
+	}
+	if o.Seed == 0 {
+		o.Seed = time.Now().UnixNano()
+	}
+}
+
+// Clients are the lnd clients used by the rebalancer, Swap is optional and only
+// needed for the Loop Out fallback and swap quotes in the advice
+type Clients struct {
+	Lightning lnrpc.LightningClient
+	Router    routerrpc.RouterClient
+	WalletKit walletrpc.WalletKitClient
+	Swap      SwapClient
+}
+
+// HopInfo describes a route hop, Node is nil and Err is set if the node info
+// couldn't be fetched
+type HopInfo struct {
+	Hop  *lnrpc.Hop
+	Node *lnrpc.NodeInfo
+	// Cached is true if the node info was found in the node cache
+	Cached bool
+	// InboundFeeMsat is the part of the hop node fee that comes from its
+	// inbound fee on the channel the payment arrives through, negative for
+	// a discount
+	InboundFeeMsat int64
+	Err            error
+}
+
+// Payment is a successful rebalance payment
+type Payment struct {
+	From      uint64
+	To        uint64
+	AmountSat int64
+	FeeMsat   int64
+}
+
+// Events are the callbacks to follow the rebalance progress, all of them are
+// optional
+type Events struct {
+	// Log receives human readable progress messages, an empty message
+	// separates groups of messages
+	Log func(msg string)
+	// Route is called before paying along the route
+	Route func(route *lnrpc.Route, hops []HopInfo)
+	// Payment is called after every successful payment including rapid
+	// rebalances
+	Payment func(p Payment)
+}
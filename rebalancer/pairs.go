@@ -0,0 +1,170 @@
+package rebalancer
+
+import (
+	"math/bits"
+	"math/rand"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// random picks before falling back to scanning the bitmap, it only happens
+// when most pairs are blocked
+const maxPairSamples = 32
+
+// pairSpace is the set of source and target channel pairs, the pairs aren't
+// stored, pair index is fromIdx*len(to)+toIdx. Pairs of channels with the same
+// peer and failed pairs are blocked in the bitmap, failed pairs are unblocked
+// after they expire.
+type pairSpace struct {
+	from       []*lnrpc.Channel
+	to         []*lnrpc.Channel
+	fromIdx    map[uint64]int
+	toIdx      map[uint64]int
+	blocked    []uint64
+	expiration map[int]time.Time
+	available  int
+}
+
+func newPairSpace(from, to []*lnrpc.Channel) *pairSpace {
+	p := &pairSpace{
+		from:       from,
+		to:         to,
+		fromIdx:    make(map[uint64]int, len(from)),
+		toIdx:      make(map[uint64]int, len(to)),
+		blocked:    make([]uint64, (len(from)*len(to)+63)/64),
+		expiration: map[int]time.Time{},
+		available:  len(from) * len(to),
+	}
+	for i, c := range from {
+		p.fromIdx[c.ChanId] = i
+	}
+	for i, c := range to {
+		p.toIdx[c.ChanId] = i
+	}
+	for i, fc := range from {
+		for j, tc := range to {
+			if fc.RemotePubkey == tc.RemotePubkey {
+				p.block(i*len(to) + j)
+			}
+		}
+	}
+	return p
+}
+
+func (p *pairSpace) isBlocked(idx int) bool {
+	return p.blocked[idx/64]&(1<<(idx%64)) != 0
+}
+
+func (p *pairSpace) block(idx int) {
+	if !p.isBlocked(idx) {
+		p.blocked[idx/64] |= 1 << (idx % 64)
+		p.available--
+	}
+}
+
+func (p *pairSpace) unblock(idx int) {
+	if p.isBlocked(idx) {
+		p.blocked[idx/64] &^= 1 << (idx % 64)
+		p.available++
+	}
+}
+
+// len returns the number of available pairs
+func (p *pairSpace) len() int {
+	return p.available
+}
+
+func (p *pairSpace) pair(idx int) (from, to *lnrpc.Channel) {
+	return p.from[idx/len(p.to)], p.to[idx%len(p.to)]
+}
+
+func (p *pairSpace) index(from, to uint64) (int, bool) {
+	fi, ok := p.fromIdx[from]
+	if !ok {
+		return 0, false
+	}
+	ti, ok := p.toIdx[to]
+	if !ok {
+		return 0, false
+	}
+	return fi*len(p.to) + ti, true
+}
+
+// pick returns a random available pair, there should be at least one
+func (p *pairSpace) pick(rnd *rand.Rand) int {
+	total := len(p.from) * len(p.to)
+	for i := 0; i < maxPairSamples; i++ {
+		idx := rnd.Intn(total)
+		if !p.isBlocked(idx) {
+			return idx
+		}
+	}
+	n := rnd.Intn(p.available)
+	for w, word := range p.blocked {
+		free := ^word
+		if w == len(p.blocked)-1 && total%64 != 0 {
+			free &= 1<<(total%64) - 1
+		}
+		cnt := bits.OnesCount64(free)
+		if n >= cnt {
+			n -= cnt
+			continue
+		}
+		for ; ; free &= free - 1 {
+			if n == 0 {
+				return w*64 + bits.TrailingZeros64(free)
+			}
+			n--
+		}
+	}
+	return -1
+}
+
+// fail blocks the pair until the expiration time
+func (p *pairSpace) fail(from, to uint64, expiration time.Time) {
+	idx, ok := p.index(from, to)
+	if !ok || p.isBlocked(idx) {
+		return
+	}
+	p.block(idx)
+	p.expiration[idx] = expiration
+}
+
+func (p *pairSpace) failed() int {
+	return len(p.expiration)
+}
+
+// expire unblocks the failed pairs that expired before the time, all of them
+// if it's zero
+func (p *pairSpace) expire(t time.Time) {
+	for idx, exp := range p.expiration {
+		if t.IsZero() || exp.Before(t) {
+			p.unblock(idx)
+			delete(p.expiration, idx)
+		}
+	}
+}
+
+// inheritFailures blocks the pairs that are still failed in the other space
+func (p *pairSpace) inheritFailures(other *pairSpace) {
+	for idx, exp := range other.expiration {
+		from, to := other.pair(idx)
+		p.fail(from.ChanId, to.ChanId, exp)
+	}
+}
+
+// sources returns the source channels with available pairs for the target
+func (p *pairSpace) sources(to uint64) []*lnrpc.Channel {
+	ti, ok := p.toIdx[to]
+	if !ok {
+		return nil
+	}
+	result := []*lnrpc.Channel{}
+	for fi, c := range p.from {
+		if !p.isBlocked(fi*len(p.to) + ti) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
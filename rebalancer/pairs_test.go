@@ -0,0 +1,108 @@
+package rebalancer
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// testChannels returns channels with ids starting from the first one, every
+// channel is with its own peer unless the peer is set
+func testChannels(first uint64, n int, peer string) []*lnrpc.Channel {
+	result := make([]*lnrpc.Channel, n)
+	for i := range result {
+		id := first + uint64(i)
+		pk := peer
+		if pk == "" {
+			pk = fmt.Sprintf("02%016x", id)
+		}
+		result[i] = &lnrpc.Channel{ChanId: id, RemotePubkey: pk}
+	}
+	return result
+}
+
+func TestPairPickSkipsBlocked(t *testing.T) {
+	from := testChannels(1, 10, "")
+	to := testChannels(100, 10, "")
+	// same peer as the first source channel
+	to[0].RemotePubkey = from[0].RemotePubkey
+	p := newPairSpace(from, to)
+	for i := 1; i < 10; i++ {
+		p.fail(from[i].ChanId, to[i].ChanId, time.Now().Add(time.Hour))
+	}
+	if p.len() != 90 || p.failed() != 9 {
+		t.Fatalf("%d pairs available, %d failed", p.len(), p.failed())
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		idx := p.pick(rnd)
+		if idx < 0 || p.isBlocked(idx) {
+			t.Fatalf("picked blocked pair %d", idx)
+		}
+		if from, to := p.pair(idx); from.RemotePubkey == to.RemotePubkey || from.ChanId+99 == to.ChanId {
+			t.Fatalf("picked pair %d => %d", from.ChanId, to.ChanId)
+		}
+	}
+}
+
+func TestPairPickScansBitmap(t *testing.T) {
+	// 10000 pairs don't fill the last bitmap word, only two are available so
+	// sampling misses them and the bitmap is scanned
+	from := testChannels(1, 200, "")
+	to := testChannels(1000, 50, "")
+	p := newPairSpace(from, to)
+	expiration := time.Now().Add(time.Hour)
+	for _, f := range from {
+		for _, c := range to {
+			p.fail(f.ChanId, c.ChanId, expiration)
+		}
+	}
+	free := map[int]bool{4321: true, len(from)*len(to) - 1: true}
+	for idx := range free {
+		p.unblock(idx)
+	}
+	if p.len() != len(free) {
+		t.Fatalf("%d pairs available", p.len())
+	}
+	rnd := rand.New(rand.NewSource(1))
+	picked := map[int]bool{}
+	for i := 0; i < 100; i++ {
+		idx := p.pick(rnd)
+		if !free[idx] {
+			t.Fatalf("picked blocked pair %d", idx)
+		}
+		picked[idx] = true
+	}
+	if len(picked) != len(free) {
+		t.Fatalf("picked only %v", picked)
+	}
+}
+
+func TestPairExpire(t *testing.T) {
+	from := testChannels(1, 2, "")
+	to := testChannels(100, 2, "")
+	p := newPairSpace(from, to)
+	now := time.Now()
+	p.fail(1, 100, now.Add(time.Minute*5))
+	p.fail(2, 101, now.Add(time.Minute*10))
+	idx, _ := p.index(1, 100)
+	p.expire(now.Add(time.Minute))
+	if !p.isBlocked(idx) || p.len() != 2 {
+		t.Fatalf("pair expired too early")
+	}
+	p.expire(now.Add(time.Minute * 6))
+	if p.isBlocked(idx) || p.len() != 3 || p.failed() != 1 {
+		t.Fatalf("pair didn't expire, %d available, %d failed", p.len(), p.failed())
+	}
+	if sources := p.sources(100); len(sources) != 2 {
+		t.Fatalf("%d sources for the unblocked target", len(sources))
+	}
+	// zero time unblocks all failed pairs
+	p.expire(time.Time{})
+	if p.len() != 4 || p.failed() != 0 {
+		t.Fatalf("%d available, %d failed", p.len(), p.failed())
+	}
+}
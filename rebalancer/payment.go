@@ -0,0 +1,208 @@
+package rebalancer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/rkfg/regolancer/format"
+)
+
+type ErrRetry struct {
+	amount int64
+}
+
+func (e ErrRetry) Error() string {
+	return fmt.Sprintf("retry payment with %d sats", e.amount)
+}
+
+// ErrRouteFailure is the failure reported by a node on the route
+type ErrRouteFailure struct {
+	failure *lnrpc.Failure
+}
+
+func (e ErrRouteFailure) Error() string {
+	return fmt.Sprintf("error: %s @ %d", e.failure.Code.String(), e.failure.FailureSourceIndex)
+}
+
+var (
+	ErrProbeFailed = fmt.Errorf("probe failed")
+	ErrFeeExceeded = fmt.Errorf("fee-limit exceeded")
+)
+
+func (r *Rebalancer) createInvoice(ctx context.Context, amount int64) (result *lnrpc.AddInvoiceResponse, err error) {
+	var ok bool
+	if result, ok = r.invoiceCache[amount]; ok {
+		return
+	}
+	result, err = r.lnClient.AddInvoice(ctx, &lnrpc.Invoice{Value: amount,
+		Memo:   "Rebalance attempt",
+		Expiry: int64(time.Hour.Seconds() * 24)})
+	r.invoiceCache[amount] = result
+
+	return
+}
+
+func (r *Rebalancer) invalidateInvoice(amount int64) {
+	delete(r.invoiceCache, amount)
+}
+
+// pay sends the amount along the route, the successful payment is recorded
+// right away or added to the split if it's not nil
+func (r *Rebalancer) pay(ctx context.Context, amount int64, minAmount int64, maxFeeMsat int64,
+	route *lnrpc.Route, probeSteps int, split *splitPayment) error {
+	r.log("")
+	defer r.log("")
+
+	if route.TotalFeesMsat > maxFeeMsat {
+		r.recordRouteFee(amount*1000, route.TotalFeesMsat)
+		r.logf("fee on the route exceeds our limits: %s ppm (max fee %s ppm)", format.FeePPM(amount*1000, route.TotalFeesMsat), format.FeePPM(amount*1000, maxFeeMsat))
+		return ErrFeeExceeded
+	}
+
+	invoice, err := r.createInvoice(ctx, amount)
+	if err != nil {
+		r.logf("Error creating invoice: %s", err)
+		return err
+	}
+	defer func() {
+		if ctx.Err() == context.DeadlineExceeded {
+			r.invalidateInvoice(amount)
+		}
+	}()
+	lastHop := route.Hops[len(route.Hops)-1]
+	lastHop.MppRecord = &lnrpc.MPPRecord{
+		PaymentAddr:  invoice.PaymentAddr,
+		TotalAmtMsat: amount * 1000,
+	}
+
+	result, err := r.routerClient.SendToRouteV2(ctx,
+		&routerrpc.SendToRouteRequest{
+			PaymentHash: invoice.RHash,
+			Route:       route,
+		})
+	if err != nil {
+		r.errorf("error sending payment %s", err)
+		return err
+	}
+	if result.Status == lnrpc.HTLCAttempt_FAILED {
+		if result.Failure.FailureSourceIndex >= uint32(len(route.Hops)) {
+			r.errorf("%s (unexpected hop index %d, should be less than %d)", result.Failure.Code.String(),
+				result.Failure.FailureSourceIndex, len(route.Hops))
+			return fmt.Errorf("error: %s @ %d", result.Failure.Code.String(),
+				result.Failure.FailureSourceIndex)
+		}
+		if result.Failure.FailureSourceIndex == 0 {
+			r.errorf("%s (unexpected hop index %d, should be greater than 0)", result.Failure.Code.String(),
+				result.Failure.FailureSourceIndex)
+			return fmt.Errorf("error: %s @ %d", result.Failure.Code.String(),
+				result.Failure.FailureSourceIndex)
+		}
+
+		prevHop := route.Hops[result.Failure.FailureSourceIndex-1]
+		failedHop := route.Hops[result.Failure.FailureSourceIndex]
+		nodeCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(r.opts.TimeoutInfo))
+		defer cancel()
+		node1, err := r.getNodeInfo(nodeCtx, prevHop.PubKey)
+		node1name := ""
+		node2name := ""
+		if err != nil {
+			node1name = fmt.Sprintf("node%d", result.Failure.FailureSourceIndex-1)
+		} else {
+			node1name = node1.Node.Alias
+		}
+		node2, err := r.getNodeInfo(nodeCtx, failedHop.PubKey)
+		if err != nil {
+			node2name = fmt.Sprintf("node%d", result.Failure.FailureSourceIndex)
+		} else {
+			node2name = node2.Node.Alias
+		}
+		r.logf("%s %s ⇒ %s", format.FaintWhite(result.Failure.Code.String()), format.Cyan(node1name), format.Cyan(node2name))
+		if result.Failure.Code == lnrpc.Failure_FEE_INSUFFICIENT || result.Failure.Code == lnrpc.Failure_CHANNEL_DISABLED {
+			r.refreshChanInfo(nodeCtx, failedHop.ChanId)
+		}
+
+		if result.Failure.Code == lnrpc.Failure_FEE_INSUFFICIENT || result.Failure.Code == lnrpc.Failure_INCORRECT_CLTV_EXPIRY {
+			failedHop := route.Hops[result.Failure.FailureSourceIndex-1]
+			updatedRoute, err := r.rebuildRoute(ctx, route, amount)
+			if err == nil {
+				updatedHop := updatedRoute.Hops[result.Failure.FailureSourceIndex-1]
+				// compare hops to make sure we do not loop endlessly
+				if !compareHops(failedHop, updatedHop) {
+					r.logf("received channelupdate after failure, trying again with amt %s and fee %s ppm",
+						format.HiWhite(amount), format.FeePPM(amount*1000, updatedRoute.TotalFeesMsat))
+					return r.pay(ctx, amount, minAmount, maxFeeMsat, updatedRoute, probeSteps, split)
+				}
+			} else {
+				r.logf("error rebuilding the route: %s", err)
+			}
+		}
+		r.addRouteFailure(route, result.Failure)
+		if probeSteps > 0 && result.Failure.Code == lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE {
+			r.logf("Probing route through %s ⇒ %s...", format.Cyan(node1name), format.Cyan(node2name))
+			maxAmount, err := r.probeMaxAmount(ctx, route, minAmount, amount, probeSteps)
+			if err != nil {
+				r.errorf("Probe error: %s", err)
+				return err
+			}
+			if maxAmount == 0 || maxAmount < minAmount {
+				return ErrProbeFailed
+			}
+			return ErrRetry{amount: maxAmount}
+		}
+		return ErrRouteFailure{failure: result.Failure}
+	} else {
+		r.logf("Success! Paid %s in fees, %s ppm",
+			format.Fee(result.Route.TotalFeesMsat), format.FeePPM(result.Route.TotalAmtMsat-result.Route.TotalFeesMsat, result.Route.TotalFeesMsat))
+		// Necessary for Rapid Rebalancing
+		r.invalidateInvoice(amount)
+		if split != nil {
+			split.amount += amount
+			split.feeMsat += result.Route.TotalFeesMsat
+			split.payments++
+			return nil
+		}
+		return r.recordPayment(route.Hops[0].ChanId, lastHop.ChanId, amount, result.Route.TotalFeesMsat)
+	}
+}
+
+// recordPayment updates the session totals, notifies about the payment and
+// saves it to the stat file
+func (r *Rebalancer) recordPayment(from, to uint64, amount int64, feeMsat int64) error {
+	r.successfulAmt += amount
+	r.paidFeesMsat += feeMsat
+	r.payments++
+	r.addPairSummary(from, to, amount, feeMsat)
+	if r.costBasis != nil {
+		r.costBasis.addPayment(from, to, amount*1000, feeMsat)
+	}
+	if r.events.Payment != nil {
+		r.events.Payment(Payment{From: from, To: to, AmountSat: amount, FeeMsat: feeMsat})
+	}
+	if r.opts.StatFilename == "" {
+		return nil
+	}
+	l := lock()
+	err := l.Lock()
+	defer l.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("error taking exclusive lock on file %s: %s", r.opts.StatFilename, err)
+	}
+
+	_, err = os.Stat(r.opts.StatFilename)
+	f, ferr := os.OpenFile(r.opts.StatFilename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if ferr != nil {
+		r.errorf("Error saving rebalance stats to %s: %s", r.opts.StatFilename, ferr)
+		return nil
+	}
+	defer f.Close()
+	if os.IsNotExist(err) {
+		f.WriteString("timestamp,from_channel,to_channel,amount_msat,fees_msat\n")
+	}
+	f.Write([]byte(fmt.Sprintf("%d,%d,%d,%d,%d\n", r.now().Unix(), from, to, amount*1000, feeMsat)))
+	return nil
+}
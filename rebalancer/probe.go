@@ -0,0 +1,341 @@
+package rebalancer
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/rkfg/regolancer/format"
+)
+
+type parallelProbe struct {
+	amount     int64
+	route      *lnrpc.Route
+	hash       []byte
+	feeTooHigh bool
+	result     *lnrpc.HTLCAttempt
+	err        error
+}
+
+// ProbeResult is the max amount that can currently pass the probed route
+type ProbeResult struct {
+	// Route is built for the max amount, it's nil if nothing can pass
+	Route     *lnrpc.Route
+	AmountSat int64
+	FeeMsat   int64
+}
+
+// probeMaxFeeMsat returns the fee limit for the probed amount, it's only
+// applied to the circular routes, the routes to other nodes are probed to
+// check the liquidity
+func (r *Rebalancer) probeMaxFeeMsat(ctx context.Context, route *lnrpc.Route, amount int64) (int64, error) {
+	if route.Hops[len(route.Hops)-1].PubKey != r.myPK {
+		return math.MaxInt64, nil
+	}
+	maxFeeMsat, _, err := r.calcFeeMsat(ctx, getSource(route), getTarget(route), amount*1000)
+	return maxFeeMsat, err
+}
+
+// probeMaxAmount finds the max amount less than the failed one the route can
+// pass, zero is returned if it's less than minAmount
+func (r *Rebalancer) probeMaxAmount(ctx context.Context, route *lnrpc.Route, minAmount, amount int64,
+	steps int) (int64, error) {
+	if r.opts.ProbeParallel > 1 {
+		return r.probeRouteParallel(ctx, route, minAmount, amount, steps)
+	}
+	min := int64(0)
+	start := amount / 2
+	if minAmount > 0 && minAmount < amount {
+		// need to use -1 so we do not fail the first probing attempt
+		min = -minAmount - 1
+		start = minAmount
+	}
+	return r.probeRoute(ctx, route, min, amount, start, steps)
+}
+
+// probeSlots returns how many probes can be in flight through our source
+// channel at once without running out of its HTLC slots
+func (r *Rebalancer) probeSlots(route *lnrpc.Route) int {
+	n := r.opts.ProbeParallel
+	c := r.findChannel(route.Hops[0].ChanId)
+	if c != nil && c.LocalConstraints != nil && c.LocalConstraints.MaxAcceptedHtlcs > 0 {
+		count, _ := pendingHtlcs(c, false)
+		n = int(min(int64(n), int64(c.LocalConstraints.MaxAcceptedHtlcs)-int64(count)))
+	}
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// probeAmounts returns n amounts evenly spread between lo and hi, lo is
+// included if it's not probed yet (the min amount in the first round)
+func probeAmounts(lo, hi int64, n int, includeLo bool) []int64 {
+	result := []int64{}
+	parts := int64(n + 1)
+	first := int64(1)
+	if includeLo {
+		parts = int64(n)
+		first = 0
+	}
+	for i := first; i < first+int64(n); i++ {
+		amt := lo + (hi-lo)*i/parts
+		if amt > lo || includeLo && amt == lo {
+			if len(result) == 0 || result[len(result)-1] != amt {
+				result = append(result, amt)
+			}
+		}
+	}
+	return result
+}
+
+// prepareProbe builds the route for the amount and checks its fee, it's done
+// sequentially because it uses the caches
+func (r *Rebalancer) prepareProbe(ctx context.Context, route *lnrpc.Route, amount int64) (*parallelProbe, error) {
+	p := &parallelProbe{amount: amount}
+	var err error
+	p.route, err = r.rebuildRoute(ctx, route, amount)
+	if err != nil {
+		return nil, err
+	}
+	maxFeeMsat, err := r.probeMaxFeeMsat(ctx, p.route, amount)
+	if err != nil {
+		return nil, err
+	}
+	if p.route.TotalFeesMsat > maxFeeMsat {
+		p.feeTooHigh = true
+		return p, nil
+	}
+	p.hash = make([]byte, 32)
+	r.rand.Read(p.hash)
+	return p, nil
+}
+
+// probeRouteParallel finds the max amount the route can pass like probeRoute
+// but sends several probes at different amounts at once every step, the
+// bracket between the best good and the smallest bad amounts shrinks faster
+// this way. Returns zero if no good amount not less than minAmount is found.
+func (r *Rebalancer) probeRouteParallel(ctx context.Context, route *lnrpc.Route, minAmount, badAmount int64,
+	steps int) (maxAmount int64, err error) {
+	// lo is the lower bound of the search, it's only a good amount if good is
+	// true, otherwise it's too expensive or not probed yet
+	lo, good := int64(0), false
+	if minAmount > 0 && minAmount < badAmount {
+		lo = minAmount
+	}
+	includeLo := lo > 0
+	slots := r.probeSlots(route)
+	defer func() {
+		if ctx.Err() == context.DeadlineExceeded && good {
+			maxAmount = lo
+			r.logf("Probing timed out with value %s", format.HiWhite(maxAmount))
+		}
+	}()
+	for ; steps > 0; steps-- {
+		if absoluteDeltaPPM(badAmount, lo) <= r.opts.FailTolerance {
+			break
+		}
+		amounts := probeAmounts(lo, badAmount, slots, includeLo)
+		if len(amounts) == 0 {
+			break
+		}
+		r.logf("Probing amounts %v, %s steps left", amounts, format.HiWhite(steps))
+		probes := []*parallelProbe{}
+		for _, amt := range amounts {
+			p, err := r.prepareProbe(ctx, route, amt)
+			if err != nil {
+				return 0, err
+			}
+			probes = append(probes, p)
+		}
+		var wg sync.WaitGroup
+		for _, p := range probes {
+			if p.feeTooHigh {
+				continue
+			}
+			wg.Add(1)
+			go func(p *parallelProbe) {
+				defer wg.Done()
+				p.result, p.err = r.routerClient.SendToRouteV2(ctx,
+					&routerrpc.SendToRouteRequest{PaymentHash: p.hash, Route: p.route})
+			}(p)
+		}
+		wg.Wait()
+		newLo, newGood, newBad := lo, good, badAmount
+		for _, p := range probes {
+			if p.feeTooHigh {
+				r.logf("%s requires too high fee %s", format.HiWhite(p.amount), format.Fee(p.route.TotalFeesMsat))
+				// smaller amounts are even more expensive in ppm because
+				// of the base fee
+				if !newGood && p.amount > newLo {
+					newLo = p.amount
+				}
+				continue
+			}
+			if p.err != nil {
+				return 0, p.err
+			}
+			if p.result.Status == lnrpc.HTLCAttempt_SUCCEEDED {
+				return 0, fmt.Errorf("this should never happen")
+			}
+			switch p.result.Failure.Code {
+			case lnrpc.Failure_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS:
+				if !newGood || p.amount > newLo {
+					newLo, newGood = p.amount, true
+				}
+			case lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE:
+				r.addRouteFailure(p.route, p.result.Failure)
+				if p.amount < newBad {
+					newBad = p.amount
+				}
+			case lnrpc.Failure_FEE_INSUFFICIENT:
+				r.logf("Fee insufficient for %s, it will be probed again", format.HiWhite(p.amount))
+			default:
+				return 0, fmt.Errorf("unknown error: %+v", p.result)
+			}
+		}
+		if includeLo && newBad == lo {
+			r.logf("Min amount %s is too much", format.HiWhite(lo))
+			return 0, nil
+		}
+		// liquidity could shift between the probes
+		if newGood && newBad <= newLo {
+			newBad = badAmount
+		}
+		lo, good, badAmount = newLo, newGood, newBad
+		includeLo = false
+	}
+	if !good {
+		r.logf("Best amount is %s", format.HiWhite("unknown"))
+		return 0, nil
+	}
+	r.logf("Best amount is %s", format.HiWhite(lo))
+	return lo, nil
+}
+
+// probedRoute builds the route for the probe command, the hops are either the
+// source and target channel ids or the node ids optionally preceded by our
+// outgoing channel id
+func (r *Rebalancer) probedRoute(ctx context.Context, hops []string, amount int64) (*lnrpc.Route, error) {
+	chanIdStrs := []string{}
+	pks := [][]byte{}
+	for _, h := range hops {
+		if len(h) != 66 {
+			if len(pks) > 0 {
+				return nil, fmt.Errorf("channel %s should precede the node ids", h)
+			}
+			chanIdStrs = append(chanIdStrs, h)
+			continue
+		}
+		pk, err := hex.DecodeString(h)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node id %s: %s", h, err)
+		}
+		pks = append(pks, pk)
+	}
+	chanIds, err := convertChanStringToInt(chanIdStrs)
+	if err != nil {
+		return nil, err
+	}
+	for _, chanId := range chanIds {
+		if r.findChannel(chanId) == nil {
+			return nil, fmt.Errorf("channel %d not found or inactive", chanId)
+		}
+	}
+	if len(pks) > 0 && len(chanIds) <= 1 {
+		outgoing := uint64(0)
+		if len(chanIds) > 0 {
+			outgoing = chanIds[0]
+		}
+		route, err := r.routerClient.BuildRoute(ctx, &routerrpc.BuildRouteRequest{
+			AmtMsat:        amount * 1000,
+			OutgoingChanId: outgoing,
+			HopPubkeys:     pks,
+			FinalCltvDelta: 144,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error building route: %s", err)
+		}
+		return route.Route, nil
+	}
+	if len(pks) > 0 || len(chanIds) != 2 {
+		return nil, fmt.Errorf("specify either the source and target channels or the node ids of the hops")
+	}
+	from, to := chanIds[0], chanIds[1]
+	routeAmt := r.routeAmount(ctx, from, to, min(amount, r.sendableMsat(r.findChannel(from))/1000,
+		r.receivableMsat(r.findChannel(to))/1000))
+	if routeAmt <= 0 {
+		return nil, fmt.Errorf("no liquidity to probe between channels %d and %d", from, to)
+	}
+	if routeAmt < amount {
+		r.logf("Channel balances and max HTLC limit the amount to %s", format.HiWhite(routeAmt))
+	}
+	routes, _, err := r.getRoutes(ctx, from, to, routeAmt*1000)
+	if err != nil {
+		return nil, fmt.Errorf("error querying routes: %s", err)
+	}
+	return routes[0], nil
+}
+
+// Probe finds the max amount up to the given one that can currently pass the
+// route with fake payment hashes, nothing is paid. The hops are either the
+// source and target channel ids or the node ids optionally preceded by our
+// outgoing channel id, the last node doesn't have to be ours. The fee limit
+// only applies to the circular routes.
+func (r *Rebalancer) Probe(ctx context.Context, hops []string, amount int64) (*ProbeResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*time.Duration(r.opts.TimeoutRebalance))
+	defer cancel()
+	route, err := r.probedRoute(ctx, hops, amount)
+	if err != nil {
+		return nil, err
+	}
+	amount = (route.TotalAmtMsat - route.TotalFeesMsat) / 1000
+	r.logf("Probing %s sat", format.Amt(amount))
+	r.reportRoute(ctx, route)
+	p, err := r.prepareProbe(ctx, route, amount)
+	if err != nil {
+		return nil, err
+	}
+	if p.feeTooHigh {
+		return nil, fmt.Errorf("fee %s sat exceeds the limit", format.Fee(p.route.TotalFeesMsat))
+	}
+	p.result, err = r.routerClient.SendToRouteV2(ctx,
+		&routerrpc.SendToRouteRequest{PaymentHash: p.hash, Route: p.route})
+	if err != nil {
+		return nil, err
+	}
+	if p.result.Status != lnrpc.HTLCAttempt_FAILED || p.result.Failure == nil {
+		return nil, fmt.Errorf("unexpected probe result: %+v", p.result)
+	}
+	maxAmount := amount
+	switch p.result.Failure.Code {
+	case lnrpc.Failure_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS:
+		r.logf("%s is good enough", format.HiWhite(amount))
+	case lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE:
+		r.addRouteFailure(p.route, p.result.Failure)
+		r.logf("%s is too much, probing at hop %s", format.HiWhite(amount),
+			format.HiWhite(p.result.Failure.FailureSourceIndex))
+		maxAmount, err = r.probeMaxAmount(ctx, p.route, r.opts.MinAmount, amount, r.opts.ProbeSteps)
+		if err != nil {
+			return nil, err
+		}
+		if maxAmount == 0 {
+			return &ProbeResult{}, nil
+		}
+	default:
+		return nil, fmt.Errorf("probe failed: %s @ %d", p.result.Failure.Code.String(),
+			p.result.Failure.FailureSourceIndex)
+	}
+	result := &ProbeResult{AmountSat: maxAmount}
+	result.Route, err = r.rebuildRoute(ctx, route, maxAmount)
+	if err != nil {
+		return nil, err
+	}
+	result.FeeMsat = result.Route.TotalFeesMsat
+	return result, nil
+}
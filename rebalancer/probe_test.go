@@ -0,0 +1,43 @@
+package rebalancer
+
+import (
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func TestProbeSlots(t *testing.T) {
+	outgoing := &lnrpc.HTLC{Amount: 1000}
+	incoming := &lnrpc.HTLC{Incoming: true, Amount: 1000}
+	tests := []struct {
+		name     string
+		parallel int
+		ch       *lnrpc.Channel
+		slots    int
+	}{
+		{name: "no constraints", parallel: 8, ch: &lnrpc.Channel{}, slots: 8},
+		{name: "free slots", parallel: 8,
+			ch:    &lnrpc.Channel{LocalConstraints: &lnrpc.ChannelConstraints{MaxAcceptedHtlcs: 483}},
+			slots: 8},
+		// only our outgoing HTLCs take the slots the peer accepts
+		{name: "pending htlcs", parallel: 8,
+			ch: &lnrpc.Channel{LocalConstraints: &lnrpc.ChannelConstraints{MaxAcceptedHtlcs: 5},
+				PendingHtlcs: []*lnrpc.HTLC{outgoing, outgoing, incoming}},
+			slots: 3},
+		{name: "no free slots", parallel: 8,
+			ch: &lnrpc.Channel{LocalConstraints: &lnrpc.ChannelConstraints{MaxAcceptedHtlcs: 2},
+				PendingHtlcs: []*lnrpc.HTLC{outgoing, outgoing}},
+			slots: 1},
+		{name: "sequential", parallel: 0, ch: &lnrpc.Channel{}, slots: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ch.ChanId = 1
+			r := &Rebalancer{opts: Options{ProbeParallel: tt.parallel}, channels: []*lnrpc.Channel{tt.ch}}
+			route := &lnrpc.Route{Hops: []*lnrpc.Hop{{ChanId: 1}, {ChanId: 2}}}
+			if slots := r.probeSlots(route); slots != tt.slots {
+				t.Fatalf("%d slots, expected %d", slots, tt.slots)
+			}
+		})
+	}
+}
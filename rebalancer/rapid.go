@@ -0,0 +1,289 @@
+package rebalancer
+
+import (
+	"fmt"
+	"math"
+)
+
+// rapid rebalance amount strategies
+const (
+	RapidStrategyDouble = "double"
+	RapidStrategyStep   = "step"
+	RapidStrategyLadder = "ladder"
+	RapidStrategyRepeat = "repeat"
+)
+
+// amount multiplier between the ladder rungs
+const ladderFactor = 1.5
+
+// rapidAttempt is the outcome of a rapid rebalance attempt
+type rapidAttempt struct {
+	// amount is what was actually attempted, it's lower than requested if the
+	// channels don't have enough liquidity
+	amount      int64
+	success     bool
+	limited     bool
+	feeExceeded bool
+	// skipped means the channels couldn't take even the min amount so nothing
+	// was attempted, the strategy should try a smaller amount next
+	skipped bool
+}
+
+// amountStrategy schedules the rapid rebalance amounts after the initial
+// rebalance succeeded, it doesn't talk to lnd so every strategy can be checked
+// on its own
+type amountStrategy interface {
+	// next returns the amount to try, false means rapid rebalance is over
+	next() (int64, bool)
+	// update reports the outcome of the amount returned by next
+	update(a rapidAttempt)
+	// capped returns true once the amount can't grow anymore because of the
+	// max HTLC on the route
+	capped() bool
+}
+
+// newAmountStrategy creates the strategy by name, base is the amount of the
+// initial rebalance, no amount is less than minAmount or more than capAmount
+// (max HTLC on the route)
+func newAmountStrategy(name string, base, minAmount, capAmount int64) (amountStrategy, error) {
+	switch name {
+	case RapidStrategyDouble:
+		return &doublingStrategy{base: base, amount: base, min: minAmount, cap: capAmount, accelerator: 1}, nil
+	case RapidStrategyStep:
+		return &stepStrategy{step: base, amount: base, min: minAmount, cap: capAmount}, nil
+	case RapidStrategyLadder:
+		return newLadderStrategy(base, minAmount, capAmount), nil
+	case RapidStrategyRepeat:
+		return &repeatStrategy{amount: min(base, capAmount), min: minAmount, atCap: base >= capAmount}, nil
+	}
+	return nil, fmt.Errorf("unknown rapid rebalance strategy %s", name)
+}
+
+// doublingStrategy doubles the amount while the rebalances succeed, then goes
+// back down halving it until the initial amount is reached and then keeps
+// halving the initial amount until it's less than the min amount
+type doublingStrategy struct {
+	base, amount, min, cap int64
+	accelerator            int64
+	decreasing             bool
+	hittingTheWall         bool
+	capReached             bool
+	exitEarly              bool
+}
+
+func (s *doublingStrategy) next() (int64, bool) {
+	for {
+		if !s.decreasing {
+			if s.hittingTheWall {
+				s.accelerator >>= 1
+				// In case we encounter that we are already constrained
+				// by the liquidity on the channels we are waiting for
+				// the accelerator to go below this amount to save
+				// already failed rebalances
+				if s.amount < s.accelerator*s.base && s.amount > s.min {
+					continue
+				}
+			} else if !s.capReached {
+				// we only increase the amount if the max amount on the
+				// route is still not reached
+				s.accelerator <<= 1
+			}
+			if s.accelerator*s.base < s.cap {
+				s.amount = s.accelerator * s.base
+			} else {
+				s.capReached = true
+			}
+			// We reached the initial amount again.
+			// now we switch to the decreasing strategy.
+			// We half the amount on every step we go down.
+			if s.accelerator < 1 {
+				s.accelerator = 2
+				s.decreasing = true
+				s.amount = s.base / s.accelerator
+				if s.amount < s.min {
+					return 0, false
+				}
+			}
+		} else {
+			s.accelerator <<= 1
+			if s.amount < s.base/s.accelerator {
+				continue
+			}
+			s.amount = s.base / s.accelerator
+			if s.amount < s.min {
+				return 0, false
+			}
+		}
+		if s.exitEarly {
+			return 0, false
+		}
+		return s.amount, true
+	}
+}
+
+func (s *doublingStrategy) update(a rapidAttempt) {
+	if a.skipped {
+		// the amount is kept so the accelerator goes below it
+		s.hittingTheWall = true
+		return
+	}
+	s.amount = a.amount
+	if a.limited {
+		// We are already using maximum available liquidity so we can
+		// begin decreasing amounts again and don't test further amounts
+		// when decreasing.
+		s.hittingTheWall = true
+		if s.decreasing {
+			s.exitEarly = true
+		}
+	}
+	// for even smaller amounts the fee will be higher because of the base
+	// fee
+	if s.decreasing && a.feeExceeded {
+		s.exitEarly = true
+	}
+	if !a.success {
+		s.hittingTheWall = true
+	}
+}
+
+func (s *doublingStrategy) capped() bool {
+	return s.capReached
+}
+
+// stepStrategy adds the initial amount while the rebalances succeed and
+// subtracts it after the first failure
+type stepStrategy struct {
+	step, amount, min, cap int64
+	decreasing             bool
+	atCap                  bool
+	done                   bool
+}
+
+func (s *stepStrategy) next() (int64, bool) {
+	if s.done {
+		return 0, false
+	}
+	if s.decreasing {
+		s.amount -= s.step
+	} else {
+		s.amount = min(s.amount+s.step, s.cap)
+		s.atCap = s.amount == s.cap
+	}
+	if s.amount < s.min || s.amount <= 0 {
+		return 0, false
+	}
+	return s.amount, true
+}
+
+func (s *stepStrategy) update(a rapidAttempt) {
+	if a.skipped {
+		s.decreasing = true
+		return
+	}
+	s.amount = a.amount
+	if s.decreasing && a.feeExceeded {
+		s.done = true
+	}
+	if a.limited || !a.success {
+		s.decreasing = true
+	}
+}
+
+func (s *stepStrategy) capped() bool {
+	return s.atCap
+}
+
+// ladderStrategy climbs the amounts growing geometrically up to the max amount
+// on the route while the rebalances succeed, after a failure it steps down one
+// rung at a time and stays on the rung while it succeeds
+type ladderStrategy struct {
+	rungs    []int64
+	rung     int
+	min, cap int64
+	down     bool
+	done     bool
+}
+
+func newLadderStrategy(base, minAmount, capAmount int64) *ladderStrategy {
+	s := &ladderStrategy{min: minAmount, cap: capAmount}
+	top := min(base, capAmount)
+	lower := []int64{}
+	for amt := float64(top) / ladderFactor; int64(amt) >= minAmount && amt >= 1; amt /= ladderFactor {
+		lower = append([]int64{int64(amt)}, lower...)
+	}
+	s.rungs = append(lower, top)
+	s.rung = len(lower)
+	for amt := float64(base) * ladderFactor; int64(amt) < capAmount && amt < math.MaxInt64/ladderFactor; amt *= ladderFactor {
+		s.rungs = append(s.rungs, int64(amt))
+	}
+	if base < capAmount {
+		s.rungs = append(s.rungs, capAmount)
+	}
+	return s
+}
+
+func (s *ladderStrategy) next() (int64, bool) {
+	if s.done || s.rung < 0 {
+		return 0, false
+	}
+	if !s.down && s.rung < len(s.rungs)-1 {
+		s.rung++
+	}
+	if s.rungs[s.rung] < s.min {
+		return 0, false
+	}
+	return s.rungs[s.rung], true
+}
+
+func (s *ladderStrategy) update(a rapidAttempt) {
+	if a.skipped {
+		s.rung--
+		s.down = true
+		return
+	}
+	if s.down && a.feeExceeded {
+		s.done = true
+		return
+	}
+	if a.limited {
+		// move below the amount the channels can take
+		for s.rung >= 0 && s.rungs[s.rung] > a.amount {
+			s.rung--
+		}
+		s.down = true
+	}
+	if !a.success {
+		s.rung--
+		s.down = true
+	}
+}
+
+func (s *ladderStrategy) capped() bool {
+	return s.rung >= 0 && s.rungs[s.rung] >= s.cap
+}
+
+// repeatStrategy repeats the same amount until it fails or the channels can't
+// take it in full
+type repeatStrategy struct {
+	amount, min int64
+	atCap       bool
+	done        bool
+}
+
+func (s *repeatStrategy) next() (int64, bool) {
+	if s.done || s.amount < s.min || s.amount <= 0 {
+		return 0, false
+	}
+	return s.amount, true
+}
+
+func (s *repeatStrategy) update(a rapidAttempt) {
+	if a.skipped || !a.success || a.limited {
+		s.done = true
+	}
+}
+
+func (s *repeatStrategy) capped() bool {
+	return s.atCap
+}
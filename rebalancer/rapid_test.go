@@ -0,0 +1,141 @@
+package rebalancer
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+// rapidChannels mimics the channels and the route of a rapid rebalance: the
+// amount is limited by the liquidity left, payments above failAbove fail and
+// payments below feeBelow exceed the fee limit because of the base fee
+type rapidChannels struct {
+	left, failAbove, feeBelow int64
+}
+
+func (c *rapidChannels) attempt(amt int64) rapidAttempt {
+	if c.left < rapidTestMin {
+		return rapidAttempt{skipped: true}
+	}
+	a := rapidAttempt{amount: amt}
+	if amt > c.left {
+		a.amount = c.left
+		a.limited = true
+	}
+	switch {
+	case a.amount > c.failAbove:
+	case a.amount < c.feeBelow:
+		a.feeExceeded = true
+	default:
+		a.success = true
+		c.left -= a.amount
+	}
+	return a
+}
+
+const (
+	rapidTestBase = 100_000
+	rapidTestMin  = 10_000
+)
+
+// runStrategy returns the amounts the strategy tried
+func runStrategy(t *testing.T, s amountStrategy, c *rapidChannels) (amounts []int64, capped bool) {
+	for {
+		amt, ok := s.next()
+		if !ok {
+			return
+		}
+		if len(amounts) == 100 {
+			t.Fatalf("strategy doesn't stop: %v", amounts)
+		}
+		amounts = append(amounts, amt)
+		capped = capped || s.capped()
+		s.update(c.attempt(amt))
+	}
+}
+
+func TestAmountStrategies(t *testing.T) {
+	noLimit := int64(math.MaxInt64)
+	tests := []struct {
+		strategy string
+		name     string
+		cap      int64
+		channels rapidChannels
+		amounts  []int64
+		capped   bool
+	}{
+		{RapidStrategyDouble, "grow", noLimit, rapidChannels{left: 1_000_000, failAbove: noLimit},
+			[]int64{200_000, 400_000, 800_000, 400_000, 200_000, 100_000, 50_000, 25_000, 12_500}, false},
+		{RapidStrategyDouble, "cap", 300_000, rapidChannels{left: 1_000_000, failAbove: noLimit},
+			[]int64{200_000, 200_000, 200_000, 200_000, 200_000, 200_000, 200_000, 100_000, 50_000, 25_000, 12_500}, true},
+		{RapidStrategyDouble, "fail", noLimit, rapidChannels{left: 1_000_000, failAbove: 300_000},
+			[]int64{200_000, 400_000, 200_000, 100_000, 50_000, 25_000, 12_500}, false},
+		{RapidStrategyDouble, "decrease", noLimit, rapidChannels{left: 250_000, failAbove: noLimit},
+			[]int64{200_000, 400_000, 50_000, 25_000, 12_500}, false},
+		{RapidStrategyDouble, "exit", noLimit, rapidChannels{left: 1_000_000, failAbove: 300_000, feeBelow: 40_000},
+			[]int64{200_000, 400_000, 200_000, 100_000, 50_000, 25_000}, false},
+		{RapidStrategyDouble, "skip", noLimit, rapidChannels{left: 0, failAbove: noLimit},
+			[]int64{200_000, 100_000, 50_000, 25_000, 12_500}, false},
+
+		{RapidStrategyStep, "grow", noLimit, rapidChannels{left: 1_000_000, failAbove: noLimit},
+			[]int64{200_000, 300_000, 400_000, 500_000}, false},
+		{RapidStrategyStep, "cap", 250_000, rapidChannels{left: 1_000_000, failAbove: noLimit},
+			[]int64{200_000, 250_000, 250_000, 250_000, 250_000}, true},
+		{RapidStrategyStep, "fail", noLimit, rapidChannels{left: 1_000_000, failAbove: 300_000},
+			[]int64{200_000, 300_000, 400_000, 300_000, 200_000, 100_000}, false},
+		{RapidStrategyStep, "decrease", noLimit, rapidChannels{left: 250_000, failAbove: noLimit},
+			[]int64{200_000, 300_000}, false},
+		{RapidStrategyStep, "exit", noLimit, rapidChannels{left: 1_000_000, failAbove: 250_000, feeBelow: 150_000},
+			[]int64{200_000, 300_000, 200_000, 100_000}, false},
+		{RapidStrategyStep, "skip", noLimit, rapidChannels{left: 0, failAbove: noLimit},
+			[]int64{200_000, 100_000}, false},
+
+		{RapidStrategyLadder, "grow", noLimit, rapidChannels{left: 1_000_000, failAbove: noLimit},
+			[]int64{150_000, 225_000, 337_500, 506_250, 225_000, 150_000, 100_000, 66_666, 44_444, 29_629,
+				19_753, 13_168}, false},
+		{RapidStrategyLadder, "cap", 250_000, rapidChannels{left: 1_000_000, failAbove: noLimit},
+			[]int64{150_000, 225_000, 250_000, 250_000, 250_000, 100_000, 66_666, 44_444, 29_629, 19_753, 13_168},
+			true},
+		{RapidStrategyLadder, "fail", noLimit, rapidChannels{left: 1_000_000, failAbove: 300_000},
+			[]int64{150_000, 225_000, 337_500, 225_000, 225_000, 225_000, 150_000, 100_000, 66_666, 44_444,
+				29_629, 19_753, 13_168}, false},
+		{RapidStrategyLadder, "decrease", noLimit, rapidChannels{left: 250_000, failAbove: noLimit},
+			[]int64{150_000, 225_000, 100_000, 66_666, 44_444, 29_629, 19_753, 13_168}, false},
+		{RapidStrategyLadder, "exit", noLimit, rapidChannels{left: 200_000, failAbove: 50_000, feeBelow: 40_000},
+			[]int64{150_000, 100_000, 66_666, 44_444, 44_444, 44_444, 44_444, 44_444}, false},
+		{RapidStrategyLadder, "skip", noLimit, rapidChannels{left: 0, failAbove: noLimit},
+			[]int64{150_000, 100_000, 66_666, 44_444, 29_629, 19_753, 13_168}, false},
+
+		{RapidStrategyRepeat, "grow", noLimit, rapidChannels{left: 350_000, failAbove: noLimit},
+			[]int64{100_000, 100_000, 100_000, 100_000}, false},
+		{RapidStrategyRepeat, "cap", 50_000, rapidChannels{left: 120_000, failAbove: noLimit},
+			[]int64{50_000, 50_000, 50_000}, true},
+		{RapidStrategyRepeat, "fail", noLimit, rapidChannels{left: 1_000_000, failAbove: 50_000},
+			[]int64{100_000}, false},
+		{RapidStrategyRepeat, "skip", noLimit, rapidChannels{left: 0, failAbove: noLimit},
+			[]int64{100_000}, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s", tt.strategy, tt.name), func(t *testing.T) {
+			s, err := newAmountStrategy(tt.strategy, rapidTestBase, rapidTestMin, tt.cap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			channels := tt.channels
+			amounts, capped := runStrategy(t, s, &channels)
+			if !slices.Equal(amounts, tt.amounts) {
+				t.Fatalf("amounts %v, expected %v", amounts, tt.amounts)
+			}
+			if capped != tt.capped {
+				t.Fatalf("capped %t, expected %t", capped, tt.capped)
+			}
+		})
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	if _, err := newAmountStrategy("triple", rapidTestBase, rapidTestMin, rapidTestBase); err == nil {
+		t.Fatal("unknown strategy accepted")
+	}
+}
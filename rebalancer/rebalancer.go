@@ -0,0 +1,357 @@
+package rebalancer
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rkfg/regolancer/format"
+)
+
+// how many times rapid rebalance can switch to another route if an
+// intermediate hop runs out of liquidity
+const maxRapidRouteSwitches = 5
+
+type rebalanceResult struct {
+	successfulAttempts int
+	failedAttempts     int
+	successfulAmt      int64
+	paidFeeMsat        int64
+}
+
+func (r *Rebalancer) tryRebalance(ctx context.Context, attempt *int) (err error,
+	repeat bool) {
+	if r.opts.TargetFirst {
+		return r.tryRebalanceTargetFirst(ctx, attempt)
+	}
+	attemptCtx, attemptCancel := context.WithTimeout(ctx, time.Minute*time.Duration(r.opts.TimeoutAttempt))
+
+	defer attemptCancel()
+
+	from, to, amt, err := r.pickChannelPair(r.rebalanceAmount(), r.opts.MinAmount, r.opts.RelAmountFrom, r.opts.RelAmountTo)
+	if err != nil {
+		r.logf(format.Err("Error during picking channel: %s"), err)
+		return err, false
+	}
+	routeCtx, routeCtxCancel := context.WithTimeout(attemptCtx, time.Second*time.Duration(r.opts.TimeoutRoute))
+	defer routeCtxCancel()
+	routes, maxFeeMsat, err := r.getRoutes(routeCtx, from, to, r.routeAmount(routeCtx, from, to, amt)*1000)
+	if err != nil {
+		if routeCtx.Err() == context.DeadlineExceeded {
+			r.log(format.Err("Timed out looking for a route"))
+			return err, false
+		}
+		r.addFailedRoute(from, to)
+		return err, true
+	}
+	routeCtxCancel()
+	for _, route := range routes {
+		if r.tryRoute(ctx, attemptCtx, route, amt, maxFeeMsat, attempt) {
+			return nil, false
+		}
+	}
+	attemptCancel()
+	if attemptCtx.Err() == context.DeadlineExceeded {
+		r.log(format.Err("Attempt timed out"))
+	}
+
+	return nil, true
+}
+
+// tryRebalanceTargetFirst picks the target channel and lets lnd choose the
+// source channel among all candidates for this target, the failed sources are
+// removed and the route is queried again until no sources are left
+func (r *Rebalancer) tryRebalanceTargetFirst(ctx context.Context, attempt *int) (err error,
+	repeat bool) {
+	attemptCtx, attemptCancel := context.WithTimeout(ctx, time.Minute*time.Duration(r.opts.TimeoutAttempt))
+
+	defer attemptCancel()
+
+	to, sources, amt, err := r.pickTarget(r.rebalanceAmount(), r.opts.MinAmount, r.opts.RelAmountFrom, r.opts.RelAmountTo)
+	if err != nil {
+		r.logf(format.Err("Error during picking channel: %s"), err)
+		return err, false
+	}
+	for len(sources) > 0 && attemptCtx.Err() == nil {
+		routeCtx, routeCtxCancel := context.WithTimeout(attemptCtx, time.Second*time.Duration(r.opts.TimeoutRoute))
+		routeAmt := r.routeAmount(routeCtx, 0, to, amt)
+		routes, err := r.getRoutesFromAny(routeCtx, sources, to, routeAmt*1000)
+		if err != nil {
+			routeCtxCancel()
+			if routeCtx.Err() == context.DeadlineExceeded {
+				r.log(format.Err("Timed out looking for a route"))
+				return err, false
+			}
+			for _, from := range sources {
+				r.addFailedRoute(from, to)
+			}
+			return err, true
+		}
+		routeCtxCancel()
+		from := getSource(routes[0])
+		maxFeeMsat, _, err := r.calcFeeMsat(attemptCtx, from, to, routeAmt*1000)
+		if err != nil {
+			r.logf("Error calculating fee for source %d: %s", from, format.Err(err))
+		} else {
+			for _, route := range routes {
+				if r.tryRoute(ctx, attemptCtx, route, amt, maxFeeMsat, attempt) {
+					return nil, false
+				}
+			}
+		}
+		r.addFailedRoute(from, to)
+		for i := range sources {
+			if sources[i] == from {
+				sources = append(sources[:i], sources[i+1:]...)
+				break
+			}
+		}
+	}
+	attemptCancel()
+	if attemptCtx.Err() == context.DeadlineExceeded {
+		r.log(format.Err("Attempt timed out"))
+	}
+
+	return nil, true
+}
+
+// tryRoute pays along the route and does rapid rebalance or probed payment if
+// requested, returns true if the rebalance succeeded
+func (r *Rebalancer) tryRoute(ctx context.Context, attemptCtx context.Context, route *lnrpc.Route,
+	amt int64, maxFeeMsat int64, attempt *int) bool {
+	if amt > (route.TotalAmtMsat-route.TotalFeesMsat)/1000 {
+		return r.trySplitRoute(attemptCtx, route, amt, maxFeeMsat, attempt)
+	}
+	r.logf("Attempt %s, amount: %s (max fee: %s sat | %s ppm )",
+		format.HiWhiteF("#%d", *attempt), format.HiWhite(amt), format.Fee(maxFeeMsat), format.FeePPM(amt*1000, maxFeeMsat))
+	r.reportRoute(attemptCtx, route)
+	err := r.pay(attemptCtx, amt, r.opts.MinAmount, maxFeeMsat, route, r.opts.ProbeSteps, nil)
+	if err == nil {
+
+		if r.opts.AllowRapidRebalance {
+			rebalanceResult, _ := r.tryRapidRebalance(ctx, route)
+
+			if rebalanceResult.successfulAttempts > 0 || rebalanceResult.failedAttempts > 0 {
+				r.logf("%s rapid rebalances were successful, total amount: %s (fee: %s sat | %s ppm) - Failed Attempts: %s\n",
+					format.HiWhite(rebalanceResult.successfulAttempts), format.HiWhite(rebalanceResult.successfulAmt),
+					format.Fee(rebalanceResult.paidFeeMsat), format.FeePPM(rebalanceResult.successfulAmt*1000, rebalanceResult.paidFeeMsat),
+					format.HiWhite(rebalanceResult.failedAttempts))
+			}
+			r.logf("Finished rapid rebalancing")
+		}
+
+		return true
+	}
+	if retryErr, ok := err.(ErrRetry); ok {
+		amt = retryErr.amount
+		r.logf("Trying to rebalance again with %s", format.HiWhite(amt))
+		probedRoute, err := r.rebuildRoute(attemptCtx, route, amt)
+		if err != nil {
+			r.logf("Error rebuilding the route for probed payment: %s", format.Err(err))
+		} else {
+			err = r.pay(attemptCtx, amt, 0, maxFeeMsat, probedRoute, 0, nil)
+			if err == nil {
+				return true
+			} else {
+				r.invalidateInvoice(amt)
+				r.logf("Probed rebalance failed with error: %s", format.Err(err))
+			}
+		}
+	}
+
+	*attempt++
+	return false
+}
+
+func (r *Rebalancer) tryRapidRebalance(ctx context.Context, route *lnrpc.Route) (result rebalanceResult, err error) {
+
+	var (
+		amt  int64  = (route.TotalAmtMsat - route.TotalFeesMsat) / 1000
+		from uint64 = getSource(route)
+		to   uint64 = getTarget(route)
+
+		// Need to save the route locally because we are changing the amount
+		// In case we reuse the route it will lead to a situation where no route is found
+		// the route variable will be overwritten and we are loosing the information
+		routeLocal           *lnrpc.Route
+		maxAmountOnRouteMsat uint64
+		minAmount            int64
+		// the amount to try again on an alternative route
+		retryAmt      int64
+		routeSwitches int
+		capLogged     bool
+	)
+
+	result.successfulAttempts = 0
+	result.failedAttempts = 0
+	// Include Initial Rebalance
+	result.successfulAmt = amt
+	result.paidFeeMsat = route.TotalFeesMsat
+
+	maxAmountOnRouteMsat, err = r.maxAmountOnRoute(ctx, route)
+	if err != nil {
+		return result, err
+	}
+
+	if r.opts.MinAmount > 0 {
+		minAmount = r.opts.MinAmount
+	} else {
+		minAmount = 10000
+	}
+	strategy, err := newAmountStrategy(r.opts.RapidStrategy, amt, minAmount, int64(maxAmountOnRouteMsat/1000))
+	if err != nil {
+		return result, err
+	}
+
+	for {
+		amtLocal, ok := retryAmt, true
+		if retryAmt == 0 {
+			amtLocal, ok = strategy.next()
+		}
+		retryAmt = 0
+		if !ok {
+			break
+		}
+		if !capLogged && strategy.capped() {
+			capLogged = true
+			r.logf("Max amount on route reached capping amount at %s sats "+
+				"| max amount on route (max htlc size) %s sats\n", format.Info(amtLocal), format.Info(maxAmountOnRouteMsat/1000))
+		}
+
+		r.logf("Rapid rebalance attempt %s, amount: %s\n", format.HiWhite(result.successfulAttempts+1), format.HiWhite(amtLocal))
+
+		err = r.refreshChannels(ctx, from, to)
+		if err != nil {
+			r.errorf("Error refreshing channels: %s", err)
+			return result, err
+		}
+		fromChan, toChan := r.findChannel(from), r.findChannel(to)
+		if !r.isSourceCandidate(fromChan, r.opts.FromPerc) || !r.isTargetCandidate(toChan, r.opts.ToPerc) {
+			r.log("Channels are not rebalance candidates anymore, stopping rapid rebalance")
+			break
+		}
+
+		// the relative amounts are recalculated from the fresh balances so
+		// that we stop right at the desired balance
+		maxAmount := r.pairMaxAmount(fromChan, toChan, r.opts.RelAmountFrom, r.opts.RelAmountTo)
+		if r.opts.RelAmountFrom > 0 || r.opts.RelAmountTo > 0 {
+			if maxAmount <= 0 || maxAmount < r.opts.MinAmount {
+				r.log("Relative amount reached, stopping rapid rebalance")
+				break
+			}
+			r.logf("Relative amount left: %s", format.HiWhite(maxAmount))
+		}
+
+		if r.opts.TotalAmount > 0 {
+			remaining := r.totalRemaining()
+			if remaining <= 0 || remaining < r.opts.MinAmount {
+				r.log("Total amount reached, stopping rapid rebalance")
+				break
+			}
+			amtLocal = min(amtLocal, remaining)
+		}
+
+		requested := amtLocal
+		attempt := rapidAttempt{}
+		attempt.amount = amtLocal
+		amtLocal = min(amtLocal, maxAmount)
+
+		if amtLocal < r.opts.MinAmount || amtLocal <= 0 {
+			r.log(format.Err("Not enough liquidity in the channels"))
+			// We are not returning an error here because
+			// in we still could rebalance an amount in the
+			// decreasing strategy.
+			strategy.update(rapidAttempt{skipped: true})
+			continue
+		}
+
+		if attempt.amount > amtLocal {
+			r.logf("Rapid fire starting with actual amount: %s (could be lower than the attempted amount in case there is less liquidity available on the channel)", format.HiWhite(amtLocal))
+			attempt.limited = true
+		}
+		attempt.amount = amtLocal
+
+		routeLocal, err = r.rebuildRoute(ctx, route, amtLocal)
+
+		if err != nil {
+			r.logf(format.Err("Error building route: %s"), err)
+			return result, err
+		}
+
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, time.Minute*time.Duration(r.opts.TimeoutAttempt))
+
+		defer attemptCancel()
+
+		// make sure we account for fees when increasing the rebalance amount
+		maxFeeMsat, _, err := r.calcFeeMsat(ctx, from, to, amtLocal*1000)
+
+		if err != nil {
+			r.logf(format.Err("Error calculating fee: %s"), err)
+			return result, err
+		}
+
+		err = r.pay(attemptCtx, amtLocal, r.opts.MinAmount, maxFeeMsat, routeLocal, 0, nil)
+		attempt.feeExceeded = errors.Is(err, ErrFeeExceeded)
+
+		attemptCancel()
+
+		if attemptCtx.Err() == context.DeadlineExceeded {
+			r.log(format.Err("Rapid rebalance attempt timed out"))
+			return result, attemptCtx.Err()
+		}
+
+		if err != nil {
+			r.logf("Rebalance failed with %s", err)
+			r.log("")
+			result.failedAttempts++
+			var failure ErrRouteFailure
+			if errors.As(err, &failure) && routeSwitches < maxRapidRouteSwitches {
+				if newRoute := r.alternativeRoute(ctx, routeLocal, failure.failure, amtLocal); newRoute != nil {
+					// the amount is not reported to the strategy, it's
+					// the route that failed
+					route = newRoute
+					routeSwitches++
+					retryAmt = requested
+					continue
+				}
+			}
+		} else {
+			attempt.success = true
+			result.successfulAttempts++
+			result.successfulAmt += amtLocal
+			result.paidFeeMsat += routeLocal.TotalFeesMsat
+		}
+		strategy.update(attempt)
+	}
+	return result, nil
+}
+
+// alternativeRoute queries a new route between the same channels avoiding the
+// hop that failed to forward the amount, nil is returned if it's our target
+// channel that failed or no route is found
+func (r *Rebalancer) alternativeRoute(ctx context.Context, route *lnrpc.Route, failure *lnrpc.Failure,
+	amount int64) *lnrpc.Route {
+	idx := int(failure.FailureSourceIndex)
+	if failure.Code != lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE || idx < 1 || idx >= len(route.Hops)-1 {
+		return nil
+	}
+	from, err := hex.DecodeString(route.Hops[idx-1].PubKey)
+	if err != nil {
+		return nil
+	}
+	to, err := hex.DecodeString(route.Hops[idx].PubKey)
+	if err != nil {
+		return nil
+	}
+	r.failedPairs = append(r.failedPairs, &lnrpc.NodePair{From: from, To: to})
+	routes, _, err := r.getRoutes(ctx, getSource(route), getTarget(route), amount*1000)
+	if err != nil {
+		r.logf("No alternative route found: %s", err)
+		return nil
+	}
+	r.logf("Switching to an alternative route avoiding channel %s", format.HiWhite(route.Hops[idx].ChanId))
+	r.reportRoute(ctx, routes[0])
+	return routes[0]
+}
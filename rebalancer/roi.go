@@ -0,0 +1,221 @@
+package rebalancer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// rebalanceROI is the outcome of a single rebalance: how much of the liquidity
+// it pushed into the target channel left through forwards and what they earned
+type rebalanceROI struct {
+	liquidityEvent
+	leftMsat   int64
+	earnedMsat int64
+	// time of the forward that used up the last of the rebalanced liquidity
+	usedUpNs uint64
+	// time of the forward that made the earned fees exceed the rebalance fee
+	paidBackNs uint64
+}
+
+// RebalanceROI shows how much of the liquidity pushed by the rebalance left
+// through forwards and what they earned, UsedUp and PaidBack are zero if the
+// liquidity is not used up or the fee is not paid back yet
+type RebalanceROI struct {
+	Timestamp  time.Time
+	From       uint64
+	To         uint64
+	AmountMsat int64
+	FeeMsat    int64
+	LeftMsat   int64
+	EarnedMsat int64
+	UsedUp     time.Duration
+	PaidBack   time.Duration
+}
+
+// PeerROI sums up the rebalances into the channels with the peer, Alias is
+// empty if the peer is unknown
+type PeerROI struct {
+	Pubkey     string
+	Alias      string
+	Rebalances int
+	AmountMsat int64
+	FeeMsat    int64
+	LeftMsat   int64
+	EarnedMsat int64
+	// number of rebalances that paid back and their average payback time
+	PaidBack   int
+	AvgPayback time.Duration
+}
+
+// ROIReport is the rebalance ROI attribution from the stat file
+type ROIReport struct {
+	Rebalances []RebalanceROI
+	// Peers are sorted from the most to the least profitable
+	Peers []*PeerROI
+}
+
+// ProfitMsat is the forward fees earned minus the rebalance fees paid
+func (p *PeerROI) ProfitMsat() int64 {
+	return p.EarnedMsat - p.FeeMsat
+}
+
+// attributeForwards spends the forwards on the rebalances into the same
+// channel, first in first out, and splits the forward fee proportionally to
+// the amount taken from every rebalance
+func attributeForwards(rebalances []*rebalanceROI, fwds []*lnrpc.ForwardingEvent) {
+	queues := map[uint64][]*rebalanceROI{}
+	events := make([]liquidityEvent, 0, len(rebalances)+len(fwds))
+	for _, rb := range rebalances {
+		events = append(events, rb.liquidityEvent)
+	}
+	fees := map[int]int64{}
+	for _, f := range fwds {
+		fees[len(events)] = int64(f.FeeMsat)
+		events = append(events, liquidityEvent{timestampNs: f.TimestampNs, chanOut: f.ChanIdOut,
+			amountMsat: int64(f.AmtOutMsat)})
+	}
+	order := make([]int, len(events))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return events[order[i]].timestampNs < events[order[j]].timestampNs
+	})
+	for _, idx := range order {
+		if idx < len(rebalances) {
+			rb := rebalances[idx]
+			queues[rb.chanIn] = append(queues[rb.chanIn], rb)
+			continue
+		}
+		e := events[idx]
+		remaining := e.amountMsat
+		queue := queues[e.chanOut]
+		for len(queue) > 0 && remaining > 0 {
+			rb := queue[0]
+			taken := min(remaining, rb.amountMsat-rb.leftMsat)
+			rb.leftMsat += taken
+			rb.earnedMsat += fees[idx] * taken / e.amountMsat
+			remaining -= taken
+			if rb.paidBackNs == 0 && rb.earnedMsat >= rb.feeMsat {
+				rb.paidBackNs = e.timestampNs
+			}
+			if rb.leftMsat == rb.amountMsat {
+				rb.usedUpNs = e.timestampNs
+				queue = queue[1:]
+			}
+		}
+		queues[e.chanOut] = queue
+	}
+}
+
+// channelPeers maps both open and closed channels to the peer pubkeys so that
+// the old rebalances are attributed too
+func (r *Rebalancer) channelPeers(ctx context.Context) (map[uint64]string, error) {
+	result := map[uint64]string{}
+	for _, c := range r.channels {
+		result[c.ChanId] = c.RemotePubkey
+	}
+	closed, err := r.lnClient.ClosedChannels(ctx, &lnrpc.ClosedChannelsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range closed.Channels {
+		result[c.ChanId] = c.RemotePubkey
+	}
+	return result, nil
+}
+
+func (r *Rebalancer) peerAlias(ctx context.Context, pubkey string) string {
+	nodeInfo, err := r.getNodeInfo(ctx, pubkey)
+	if err != nil {
+		return ""
+	}
+	return nodeInfo.Node.Alias
+}
+
+// ROI matches the rebalances recorded in the stat file with the forwards
+// and summarizes it for every target peer
+func (r *Rebalancer) ROI(ctx context.Context, statFilename string) (*ROIReport, error) {
+	records, err := readStatRecords(statFilename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading stat file: %s", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no rebalances in the stat file %s", statFilename)
+	}
+	rebalances := make([]*rebalanceROI, 0, len(records))
+	for _, rec := range records {
+		e, err := parseStatRecord(rec)
+		if err != nil {
+			return nil, err
+		}
+		rebalances = append(rebalances, &rebalanceROI{liquidityEvent: e})
+	}
+	start := rebalances[0].timestampNs
+	for _, rb := range rebalances {
+		if rb.timestampNs < start {
+			start = rb.timestampNs
+		}
+	}
+	fwds, err := r.getForwards(ctx, time.Unix(0, int64(start)), r.now())
+	if err != nil {
+		return nil, fmt.Errorf("error loading forwarding history: %s", err)
+	}
+	attributeForwards(rebalances, fwds)
+	chanPeers, err := r.channelPeers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing closed channels: %s", err)
+	}
+	return sumROI(rebalances, chanPeers, func(pubkey string) string {
+		return r.peerAlias(ctx, pubkey)
+	}), nil
+}
+
+// sumROI sums up the rebalances by the target peer, alias is only called for
+// the known peers
+func sumROI(rebalances []*rebalanceROI, chanPeers map[uint64]string, alias func(pubkey string) string) *ROIReport {
+	result := &ROIReport{}
+	peers := map[string]*PeerROI{}
+	paybackNs := map[string]uint64{}
+	for _, rb := range rebalances {
+		pubkey := chanPeers[rb.chanIn]
+		p, ok := peers[pubkey]
+		if !ok {
+			p = &PeerROI{Pubkey: pubkey}
+			if pubkey != "" {
+				p.Alias = alias(pubkey)
+			}
+			peers[pubkey] = p
+			result.Peers = append(result.Peers, p)
+		}
+		p.Rebalances++
+		p.AmountMsat += rb.amountMsat
+		p.FeeMsat += rb.feeMsat
+		p.LeftMsat += rb.leftMsat
+		p.EarnedMsat += rb.earnedMsat
+		roi := RebalanceROI{Timestamp: time.Unix(0, int64(rb.timestampNs)), From: rb.chanOut, To: rb.chanIn,
+			AmountMsat: rb.amountMsat, FeeMsat: rb.feeMsat, LeftMsat: rb.leftMsat, EarnedMsat: rb.earnedMsat}
+		if rb.usedUpNs > 0 {
+			roi.UsedUp = time.Duration(rb.usedUpNs - rb.timestampNs)
+		}
+		if rb.paidBackNs > 0 {
+			roi.PaidBack = time.Duration(rb.paidBackNs - rb.timestampNs)
+			p.PaidBack++
+			paybackNs[pubkey] += rb.paidBackNs - rb.timestampNs
+		}
+		result.Rebalances = append(result.Rebalances, roi)
+	}
+	for _, p := range result.Peers {
+		if p.PaidBack > 0 {
+			p.AvgPayback = time.Duration(paybackNs[p.Pubkey] / uint64(p.PaidBack))
+		}
+	}
+	sort.SliceStable(result.Peers, func(i, j int) bool {
+		return result.Peers[i].ProfitMsat() > result.Peers[j].ProfitMsat()
+	})
+	return result
+}
@@ -0,0 +1,56 @@
+package rebalancer
+
+import (
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func TestAttributeForwards(t *testing.T) {
+	// channels 1 and 2 are with the same peer, 2 got no rebalances
+	chanPeers := map[uint64]string{1: testPeerPK, 2: testPeerPK, 3: testPK}
+	rebalances := []*rebalanceROI{
+		{liquidityEvent: liquidityEvent{timestampNs: 1, chanOut: 9, chanIn: 1, amountMsat: 1_000_000, feeMsat: 1000}},
+		{liquidityEvent: liquidityEvent{timestampNs: 2, chanOut: 9, chanIn: 3, amountMsat: 500_000, feeMsat: 500}},
+		{liquidityEvent: liquidityEvent{timestampNs: 4, chanOut: 9, chanIn: 1, amountMsat: 1_000_000, feeMsat: 2000}},
+	}
+	fwds := []*lnrpc.ForwardingEvent{
+		// uses up the first rebalance, the rest wasn't rebalanced
+		{TimestampNs: 3, ChanIdOut: 1, AmtOutMsat: 1_500_000, FeeMsat: 3000},
+		{TimestampNs: 5, ChanIdOut: 1, AmtOutMsat: 400_000, FeeMsat: 400},
+		{TimestampNs: 6, ChanIdOut: 3, AmtOutMsat: 200_000, FeeMsat: 1000},
+		{TimestampNs: 7, ChanIdOut: 2, AmtOutMsat: 100_000, FeeMsat: 100},
+	}
+	attributeForwards(rebalances, fwds)
+	expected := []rebalanceROI{
+		{leftMsat: 1_000_000, earnedMsat: 2000, usedUpNs: 3, paidBackNs: 3},
+		{leftMsat: 200_000, earnedMsat: 1000, paidBackNs: 6},
+		{leftMsat: 400_000, earnedMsat: 400},
+	}
+	for i, e := range expected {
+		rb := rebalances[i]
+		if rb.leftMsat != e.leftMsat || rb.earnedMsat != e.earnedMsat || rb.usedUpNs != e.usedUpNs ||
+			rb.paidBackNs != e.paidBackNs {
+			t.Errorf("rebalance %d: %+v, expected %+v", i, *rb, e)
+		}
+	}
+	report := sumROI(rebalances, chanPeers, func(pubkey string) string { return "alias " + pubkey })
+	expectedPeers := []PeerROI{
+		{Pubkey: testPK, Alias: "alias " + testPK, Rebalances: 1, AmountMsat: 500_000, FeeMsat: 500,
+			LeftMsat: 200_000, EarnedMsat: 1000, PaidBack: 1, AvgPayback: 4},
+		{Pubkey: testPeerPK, Alias: "alias " + testPeerPK, Rebalances: 2, AmountMsat: 2_000_000, FeeMsat: 3000,
+			LeftMsat: 1_400_000, EarnedMsat: 2400, PaidBack: 1, AvgPayback: 2},
+	}
+	if len(report.Peers) != len(expectedPeers) {
+		t.Fatalf("unexpected peers %+v", report.Peers)
+	}
+	// sorted by profit
+	for i, e := range expectedPeers {
+		if *report.Peers[i] != e {
+			t.Errorf("peer %d: %+v, expected %+v", i, *report.Peers[i], e)
+		}
+	}
+	if len(report.Rebalances) != 3 || report.Rebalances[0].UsedUp != 2 || report.Rebalances[1].PaidBack != 4 {
+		t.Errorf("unexpected rebalances %+v", report.Rebalances)
+	}
+}
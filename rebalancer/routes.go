@@ -0,0 +1,452 @@
+package rebalancer
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/rkfg/regolancer/format"
+)
+
+func (r *Rebalancer) getChanInfo(ctx context.Context, chanId uint64) (*lnrpc.ChannelEdge, error) {
+	if c, ok := r.chanCache[chanId]; ok && !c.expired(r.opts.ChanCacheLifetime, r.now()) {
+		return c.ChannelEdge, nil
+	}
+	c, err := r.lnClient.GetChanInfo(ctx, &lnrpc.ChanInfoRequest{ChanId: chanId})
+	if err != nil {
+		return nil, err
+	}
+	r.chanCache[chanId] = newCachedChanInfo(c, r.now())
+	return c, nil
+}
+
+// refreshChanInfo fetches the edge again after a node reported that its
+// policy we used is outdated
+func (r *Rebalancer) refreshChanInfo(ctx context.Context, chanId uint64) {
+	delete(r.chanCache, chanId)
+	_, err := r.getChanInfo(ctx, chanId)
+	if err != nil {
+		r.errorf("Error refreshing channel %d: %s", chanId, err)
+	}
+}
+
+func (r *Rebalancer) calcFeeLimitMsat(ctx context.Context, to uint64,
+	amtMsat int64, ppm int64) (feeMsat int64, lastPKstr string, err error) {
+	cTo, err := r.getChanInfo(ctx, to)
+	if err != nil {
+		return 0, "", err
+	}
+	lastPKstr = cTo.Node1Pub
+	if lastPKstr == r.myPK {
+		lastPKstr = cTo.Node2Pub
+	}
+	feeMsat = amtMsat * ppm / 1e6
+	return
+}
+
+// nodePolicy returns the policy the node sets for the channel
+func nodePolicy(c *lnrpc.ChannelEdge, pk string) *lnrpc.RoutingPolicy {
+	if c.Node1Pub == pk {
+		return c.Node1Policy
+	}
+	return c.Node2Policy
+}
+
+// ownPolicy returns our policy of the channel
+func (r *Rebalancer) ownPolicy(ctx context.Context, chanId uint64) (*lnrpc.RoutingPolicy, error) {
+	c, err := r.getChanInfo(ctx, chanId)
+	if err != nil {
+		return nil, err
+	}
+	return nodePolicy(c, r.myPK), nil
+}
+
+// calcLostProfitMsat returns the fee we could earn by routing the amount out of
+// the source channel if lost profit accounting is enabled, such payments come
+// through the target channel so its inbound fee is included
+func (r *Rebalancer) calcLostProfitMsat(ctx context.Context, from, to uint64, amtMsat int64) (int64, error) {
+	// source is unknown when lnd picks it, the fee is checked again after the
+	// route is found
+	if !r.opts.LostProfit || from == 0 {
+		return 0, nil
+	}
+	policyFrom, err := r.ownPolicy(ctx, from)
+	if err != nil {
+		return 0, err
+	}
+	policyTo, err := r.ownPolicy(ctx, to)
+	if err != nil {
+		return 0, err
+	}
+	return ForwardFeeMsat(policyTo, policyFrom, amtMsat), nil
+}
+
+func (r *Rebalancer) calcEconFeeMsat(ctx context.Context, from, to uint64, amtMsat int64, ratio float64) (feeMsat int64,
+	lastPKstr string, err error) {
+	cTo, err := r.getChanInfo(ctx, to)
+	if err != nil {
+		return 0, "", err
+	}
+	lastPKstr = cTo.Node1Pub
+	policyTo := cTo.Node2Policy
+	if lastPKstr == r.myPK {
+		lastPKstr = cTo.Node2Pub
+		policyTo = cTo.Node1Policy
+	}
+	// the liquidity we buy is expected to be sold to the payments that come
+	// back through the source channel so our inbound fee there counts too
+	var policyFrom *lnrpc.RoutingPolicy
+	if from != 0 {
+		policyFrom, err = r.ownPolicy(ctx, from)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+	lostProfitMsat, err := r.calcLostProfitMsat(ctx, from, to, amtMsat)
+	if err != nil {
+		return 0, "", err
+	}
+	feeMsat = int64(float64(ForwardFeeMsat(policyFrom, policyTo, amtMsat))*ratio) - lostProfitMsat
+
+	if r.opts.EconRatioMaxPPM != 0 && int64(float64(feeMsat)/float64(amtMsat)*1e6) > r.opts.EconRatioMaxPPM {
+		feeMsat = r.opts.EconRatioMaxPPM * amtMsat / 1e6
+	}
+	if feeMsat < 0 {
+		return 0, "", fmt.Errorf("max fee less than zero")
+	}
+	return
+}
+
+func (r *Rebalancer) calcFeeMsat(ctx context.Context, from, to uint64,
+	amtMsat int64) (feeMsat int64, lastPKstr string, err error) {
+	if r.opts.FeeLimitPPM > 0 {
+		feeMsat, lastPKstr, err = r.calcFeeLimitMsat(ctx, to, amtMsat, r.opts.FeeLimitPPM)
+	} else if r.opts.EconForwardsDays > 0 {
+		feeMsat, lastPKstr, err = r.calcForwardsFeeMsat(ctx, from, to, amtMsat)
+	} else {
+		feeMsat, lastPKstr, err = r.calcEconFeeMsat(ctx, from, to, amtMsat, r.opts.EconRatio)
+	}
+	if err == nil && r.opts.FeeGuard {
+		var guardMsat int64
+		guardMsat, err = r.calcFeeGuardMsat(ctx, to, amtMsat, r.opts.FeeGuardMargin)
+		feeMsat = min(feeMsat, guardMsat)
+	}
+	return r.goalFeeLimitMsat(feeMsat), lastPKstr, err
+}
+
+func (r *Rebalancer) getRoutes(ctx context.Context, from, to uint64, amtMsat int64) ([]*lnrpc.Route, int64, error) {
+	routeCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(r.opts.TimeoutRoute))
+	defer cancel()
+	feeMsat, lastPKstr, err := r.calcFeeMsat(routeCtx, from, to, amtMsat)
+	if err != nil {
+		return nil, 0, err
+	}
+	lastPK, err := hex.DecodeString(lastPKstr)
+	if err != nil {
+		return nil, 0, err
+	}
+	req := &lnrpc.QueryRoutesRequest{
+		PubKey:            r.myPK,
+		OutgoingChanId:    from,
+		LastHopPubkey:     lastPK,
+		AmtMsat:           amtMsat,
+		UseMissionControl: true,
+		FeeLimit:          &lnrpc.FeeLimit{Limit: &lnrpc.FeeLimit_FixedMsat{FixedMsat: feeMsat}},
+		IgnoredNodes:      r.excludeNodes,
+		IgnoredPairs:      r.failedPairs,
+	}
+	routes, err := r.lnClient.QueryRoutes(routeCtx, req)
+	if err != nil {
+		r.recordCheapestRoute(routeCtx, req)
+		return nil, 0, err
+	}
+	result := []*lnrpc.Route{}
+	for i := range routes.Routes { // lnd always returns 1 route for now but just in case it changes
+		if err := r.validateRoute(routes.Routes[i]); err == nil {
+			result = append(result, routes.Routes[i])
+		} else {
+			r.log(err.Error())
+		}
+	}
+	if len(result) == 0 {
+		return r.getRoutes(ctx, from, to, amtMsat)
+	}
+	r.routeFound = true
+	return result, feeMsat, nil
+}
+
+// getRoutesFromAny queries routes that can start from any of the source
+// channels, our other channels are ignored so that lnd picks the best source.
+// QueryRoutes in the lnd version we use has no OutgoingChanIds (only
+// OutgoingChanId for a single channel) so the sources are set by ignoring the
+// edges of all other channels.
+func (r *Rebalancer) getRoutesFromAny(ctx context.Context, sources []uint64, to uint64, amtMsat int64) ([]*lnrpc.Route, error) {
+	routeCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(r.opts.TimeoutRoute))
+	defer cancel()
+	feeMsat, lastPKstr, err := r.calcFeeMsat(routeCtx, 0, to, amtMsat)
+	if err != nil {
+		return nil, err
+	}
+	lastPK, err := hex.DecodeString(lastPKstr)
+	if err != nil {
+		return nil, err
+	}
+	// private channels can be used as the first hop too so all active
+	// channels should be considered
+	channels, err := r.lnClient.ListChannels(routeCtx, &lnrpc.ListChannelsRequest{ActiveOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	sourceSet := makeChanSet(sources)
+	ignoredEdges := []*lnrpc.EdgeLocator{}
+	for _, c := range channels.Channels {
+		if _, ok := sourceSet[c.ChanId]; !ok {
+			ignoredEdges = append(ignoredEdges, &lnrpc.EdgeLocator{
+				ChannelId:        c.ChanId,
+				DirectionReverse: r.myPK > c.RemotePubkey,
+			})
+		}
+	}
+	req := &lnrpc.QueryRoutesRequest{
+		PubKey:            r.myPK,
+		LastHopPubkey:     lastPK,
+		AmtMsat:           amtMsat,
+		UseMissionControl: true,
+		FeeLimit:          &lnrpc.FeeLimit{Limit: &lnrpc.FeeLimit_FixedMsat{FixedMsat: feeMsat}},
+		IgnoredNodes:      r.excludeNodes,
+		IgnoredPairs:      r.failedPairs,
+		IgnoredEdges:      ignoredEdges,
+	}
+	routes, err := r.lnClient.QueryRoutes(routeCtx, req)
+	if err != nil {
+		r.recordCheapestRoute(routeCtx, req)
+		return nil, err
+	}
+	result := []*lnrpc.Route{}
+	for i := range routes.Routes {
+		if _, ok := sourceSet[getSource(routes.Routes[i])]; !ok {
+			return nil, fmt.Errorf("route starts with unexpected channel %d", getSource(routes.Routes[i]))
+		}
+		if err := r.validateRoute(routes.Routes[i]); err == nil {
+			result = append(result, routes.Routes[i])
+		} else {
+			r.log(err.Error())
+		}
+	}
+	if len(result) == 0 {
+		return r.getRoutesFromAny(ctx, sources, to, amtMsat)
+	}
+	r.routeFound = true
+	return result, nil
+}
+
+func (r *Rebalancer) getNodeInfo(ctx context.Context, pk string) (*lnrpc.NodeInfo, error) {
+	if nodeInfo, ok := r.nodeCache[pk]; ok {
+		return nodeInfo.NodeInfo, nil
+	}
+	nodeInfo, err := r.lnClient.GetNodeInfo(ctx, &lnrpc.NodeInfoRequest{PubKey: pk})
+	if err == nil {
+		r.nodeCache[pk] = cachedNodeInfo{
+			NodeInfo:  nodeInfo,
+			Timestamp: r.now(),
+		}
+	}
+	return nodeInfo, err
+}
+
+// reportRoute sends the route with the hop nodes information to the Route
+// callback
+func (r *Rebalancer) reportRoute(ctx context.Context, route *lnrpc.Route) {
+	if len(route.Hops) == 0 || r.events.Route == nil {
+		return
+	}
+	hops := []HopInfo{}
+	for i, hop := range route.Hops {
+		_, cached := r.nodeCache[hop.PubKey]
+		nodeInfo, err := r.getNodeInfo(ctx, hop.PubKey)
+		hops = append(hops, HopInfo{Hop: hop, Node: nodeInfo, Cached: cached,
+			InboundFeeMsat: r.hopInboundFeeMsat(ctx, route, i), Err: err})
+	}
+	r.events.Route(route, hops)
+}
+
+// hopInboundFeeMsat returns the inbound fee part of the fee the hop node
+// charges for forwarding to the next hop, it's only shown to the user so the
+// errors are ignored
+func (r *Rebalancer) hopInboundFeeMsat(ctx context.Context, route *lnrpc.Route, idx int) int64 {
+	if idx >= len(route.Hops)-1 {
+		return 0
+	}
+	pk := route.Hops[idx].PubKey
+	next := route.Hops[idx+1]
+	in, err := r.getChanInfo(ctx, route.Hops[idx].ChanId)
+	if err != nil {
+		return 0
+	}
+	out, err := r.getChanInfo(ctx, next.ChanId)
+	if err != nil {
+		return 0
+	}
+	amtMsat := next.AmtToForwardMsat + next.FeeMsat
+	outFeeMsat := PolicyFeeMsat(nodePolicy(out, pk), amtMsat)
+	return GetInboundFee(nodePolicy(in, pk)).FeeMsat(amtMsat + outFeeMsat)
+}
+
+func (r *Rebalancer) rebuildRoute(ctx context.Context, route *lnrpc.Route, amount int64) (*lnrpc.Route, error) {
+	pks := [][]byte{}
+	for _, h := range route.Hops {
+		pk, _ := hex.DecodeString(h.PubKey)
+		pks = append(pks, pk)
+	}
+	resultRoute, err := r.routerClient.BuildRoute(ctx, &routerrpc.BuildRouteRequest{
+		AmtMsat:        amount * 1000,
+		OutgoingChanId: route.Hops[0].ChanId,
+		HopPubkeys:     pks,
+		FinalCltvDelta: 144,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resultRoute.Route, err
+}
+
+func (r *Rebalancer) probeRoute(ctx context.Context, route *lnrpc.Route,
+	goodAmount, badAmount, amount int64, steps int) (maxAmount int64, err error) {
+
+	defer func() {
+		if ctx.Err() == context.DeadlineExceeded && goodAmount > 0 {
+			maxAmount = goodAmount
+			r.logf("Probing timed out with value %s", format.HiWhite(maxAmount))
+
+		}
+	}()
+
+	if absoluteDeltaPPM(badAmount, amount) <= r.opts.FailTolerance || absoluteDeltaPPM(amount, goodAmount) <= r.opts.FailTolerance || amount == -goodAmount {
+		bestAmount := format.HiWhite(goodAmount)
+		maxAmount = goodAmount
+		if goodAmount <= 0 {
+			bestAmount = format.HiWhite("unknown")
+			maxAmount = 0
+		}
+		r.logf("Best amount is %s", bestAmount)
+		return
+	}
+	probedRoute, err := r.rebuildRoute(ctx, route, amount)
+	if err != nil {
+		return
+	}
+	maxFeeMsat, err := r.probeMaxFeeMsat(ctx, probedRoute, amount)
+	if err != nil {
+		return
+	}
+	if probedRoute.TotalFeesMsat > maxFeeMsat {
+		nextAmount := amount + (badAmount-amount)/2
+		r.logf("%s requires too high fee %s (max allowed is %s), increasing amount to %s",
+			format.HiWhite(amount), format.Fee(probedRoute.TotalFeesMsat),
+			format.Fee(maxFeeMsat), format.HiWhite(nextAmount))
+		// returning negative amount as "good", it's a special case which means
+		// this is rather the lower bound and the actual good amount is still
+		// unknown
+		return r.probeRoute(ctx, route, -amount, badAmount, nextAmount, steps)
+	}
+	fakeHash := make([]byte, 32)
+	r.rand.Read(fakeHash)
+	result, err := r.routerClient.SendToRouteV2(ctx,
+		&routerrpc.SendToRouteRequest{
+			PaymentHash: fakeHash,
+			Route:       probedRoute,
+		})
+	if err != nil {
+		return
+	}
+	if result.Status == lnrpc.HTLCAttempt_SUCCEEDED {
+		return 0, fmt.Errorf("this should never happen")
+	}
+	if result.Status == lnrpc.HTLCAttempt_FAILED {
+		if result.Failure.Code == lnrpc.Failure_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS { // payment can succeed
+			if steps == 1 {
+				r.logf("best amount is %s", format.HiWhite(amount))
+				maxAmount = amount
+				return
+			}
+			nextAmount := amount + (badAmount-amount)/2
+			r.logf("%s is good enough, trying amount %s, %s steps left",
+				format.HiWhite(amount), format.HiWhite(nextAmount),
+				format.HiWhite(steps-1))
+			return r.probeRoute(ctx, route, amount, badAmount, nextAmount,
+				steps-1)
+		}
+		if result.Failure.Code == lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE {
+			r.addRouteFailure(probedRoute, result.Failure)
+			if steps == 1 {
+				maxAmount = goodAmount
+				bestAmount := format.HiWhite(goodAmount)
+				if goodAmount <= 0 {
+					bestAmount = format.HiWhite("unknown")
+					maxAmount = 0
+				}
+				r.logf("%s is too much, best amount is %s",
+					format.HiWhite(amount), bestAmount)
+				return
+			}
+			var nextAmount int64
+			if goodAmount >= 0 {
+				nextAmount = amount + (goodAmount-amount)/2
+			} else {
+				nextAmount = amount - (goodAmount+amount)/2
+			}
+			r.logf("%s is too much, lowering amount to %s, %s steps left",
+				format.HiWhite(amount), format.HiWhite(nextAmount),
+				format.HiWhite(steps-1))
+			return r.probeRoute(ctx, route, goodAmount, amount, nextAmount,
+				steps-1)
+		}
+		if result.Failure.Code == lnrpc.Failure_FEE_INSUFFICIENT {
+			r.logf("Fee insufficient, retrying...")
+			return r.probeRoute(ctx, route, goodAmount, badAmount, amount,
+				steps)
+		}
+	}
+	return 0, fmt.Errorf("unknown error: %+v", result)
+}
+
+func (r *Rebalancer) makeNodeList(nodes []string) error {
+	for _, nid := range nodes {
+		if len(nid) != 66 {
+			return fmt.Errorf("invalid node id (%s) length, expected 66 characters, got %d", nid, len(nid))
+		}
+		pk, err := hex.DecodeString(nid)
+		if err != nil {
+			return err
+		}
+		r.excludeNodes = append(r.excludeNodes, pk)
+	}
+	return nil
+}
+
+func getSource(route *lnrpc.Route) uint64 {
+	if len(route.Hops) > 0 {
+		return route.Hops[0].ChanId
+	}
+	return 0
+}
+
+func getTarget(route *lnrpc.Route) uint64 {
+	if len(route.Hops) > 0 {
+		return route.Hops[len(route.Hops)-1].ChanId
+	}
+	return 0
+
+}
+
+func compareHops(hop1 *lnrpc.Hop, hop2 *lnrpc.Hop) bool {
+	if hop1 == nil || hop2 == nil {
+		return false
+	}
+	return hop1.ChanId == hop2.ChanId &&
+		hop1.FeeMsat == hop2.FeeMsat &&
+		hop1.Expiry == hop2.Expiry
+}
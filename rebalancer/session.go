@@ -0,0 +1,314 @@
+// Package rebalancer implements circular rebalancing of lnd channels, it's the
+// engine behind the regolancer command.
+package rebalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/walletrpc"
+	"github.com/rkfg/regolancer/format"
+)
+
+// ErrTimeout is returned by Rebalance when the session times out
+var ErrTimeout = errors.New("rebalancing timed out")
+
+type cachedNodeInfo struct {
+	*lnrpc.NodeInfo
+	Timestamp time.Time
+}
+
+// Rebalancer holds the rebalance session state, it's not safe for concurrent
+// use
+type Rebalancer struct {
+	opts             Options
+	events           Events
+	lnClient         lnrpc.LightningClient
+	routerClient     routerrpc.RouterClient
+	walletClient     walletrpc.WalletKitClient
+	swap             SwapClient
+	rand             *rand.Rand
+	myPK             string
+	blockHeight      uint32
+	channels         []*lnrpc.Channel
+	fromChannels     []*lnrpc.Channel
+	fromChannelId    map[uint64]struct{}
+	toChannels       []*lnrpc.Channel
+	toChannelId      map[uint64]struct{}
+	pairs            *pairSpace
+	candidatesErr    error
+	nodeCache        map[string]cachedNodeInfo
+	chanCache        map[uint64]cachedChanInfo
+	excludeTo        map[uint64]struct{}
+	excludeFrom      map[uint64]struct{}
+	excludeBoth      map[uint64]struct{}
+	excludeNodes     [][]byte
+	routeFound       bool
+	invoiceCache     map[int64]*lnrpc.AddInvoiceResponse
+	mcCache          map[string]int64
+	failedPairs      []*lnrpc.NodePair
+	goal             *rebalanceGoal
+	forwardStats     map[uint64]forwardStat
+	cheapestRoutePPM int64
+	costBasis        *costBasis
+	successfulAmt    int64
+	paidFeesMsat     int64
+	payments         int
+	rebalances       int
+	pairSummary      []PairSummary
+	pairSummaryIdx   map[[2]uint64]int
+}
+
+// Result sums up the rebalance session
+type Result struct {
+	AmountSat   int64
+	FeesMsat    int64
+	Payments    int
+	Attempts    int
+	GoalReached bool
+	// Pairs sums up the payments per source and target channel pair
+	Pairs []PairSummary
+	// Swap is set if the Loop Out fallback started a swap
+	Swap *LoopOutResponse
+}
+
+func (r *Rebalancer) now() time.Time {
+	if r.opts.Now != nil {
+		return r.opts.Now()
+	}
+	return time.Now()
+}
+
+func (r *Rebalancer) log(msg string) {
+	if r.events.Log != nil {
+		r.events.Log(msg)
+	}
+}
+
+func (r *Rebalancer) logf(f string, args ...any) {
+	r.log(fmt.Sprintf(f, args...))
+}
+
+func (r *Rebalancer) errorf(f string, args ...any) {
+	r.log(format.ErrF(f, args...))
+}
+
+// New connects to the node, selects the source and target channels and
+// prepares everything for rebalancing
+func New(ctx context.Context, clients Clients, opts Options, events Events) (*Rebalancer, error) {
+	opts.setDefaults()
+	if opts.LoopOutFallback && clients.Swap == nil {
+		return nil, fmt.Errorf("loop out fallback requires the swap client")
+	}
+	switch opts.RapidStrategy {
+	case RapidStrategyDouble, RapidStrategyStep, RapidStrategyLadder, RapidStrategyRepeat:
+	default:
+		return nil, fmt.Errorf("unknown rapid rebalance strategy %s", opts.RapidStrategy)
+	}
+	r := &Rebalancer{
+		opts:           opts,
+		events:         events,
+		lnClient:       clients.Lightning,
+		routerClient:   clients.Router,
+		walletClient:   clients.WalletKit,
+		swap:           clients.Swap,
+		rand:           rand.New(rand.NewSource(opts.Seed)),
+		nodeCache:      map[string]cachedNodeInfo{},
+		chanCache:      map[uint64]cachedChanInfo{},
+		mcCache:        map[string]int64{},
+		invoiceCache:   map[int64]*lnrpc.AddInvoiceResponse{},
+		pairSummaryIdx: map[[2]uint64]int{},
+	}
+	infoCtx, infoCtxCancel := context.WithTimeout(ctx, time.Second*time.Duration(opts.TimeoutInfo))
+	defer infoCtxCancel()
+	info, err := r.lnClient.GetInfo(infoCtx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return nil, err
+	}
+	r.myPK = info.IdentityPubkey
+	r.blockHeight = info.BlockHeight
+	err = r.getChannels(infoCtx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing own channels: %s", err)
+	}
+	err = r.selectChannels(infoCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.EconForwardsDays > 0 {
+		err = r.loadForwardStats(infoCtx, opts.EconForwardsDays, opts.EconForwardsMinVolume,
+			opts.EconForwardsNoHistoryPPM == 0)
+		if err != nil {
+			return nil, fmt.Errorf("error loading forwarding history: %s", err)
+		}
+	}
+
+	if opts.Goal != "" {
+		err = r.setupGoal(opts.Goal, opts.GoalFeeBudget)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up goal: %s", err)
+		}
+	}
+	if opts.Drain != "" {
+		err = r.setupDrain(opts.Drain, opts.DrainThreshold, opts.GoalFeeBudget)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up drain: %s", err)
+		}
+	}
+
+	// the candidates are only needed for rebalancing, advice and reports
+	// make sense without them
+	r.candidatesErr = r.getChannelCandidates(r.opts.FromPerc, r.opts.ToPerc, r.opts.Amount)
+
+	err = r.loadNodeCache(opts.NodeCacheFilename, opts.NodeCacheLifetime, true)
+	if err != nil {
+		r.errorf("%s", err)
+	}
+	err = r.loadChanCache(opts.ChanCacheFilename, opts.ChanCacheLifetime, true)
+	if err != nil {
+		r.errorf("%s", err)
+	}
+	if opts.CostBasisFilename != "" {
+		err = r.syncCostBasis(infoCtx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Rebalancer) selectChannels(ctx context.Context) (err error) {
+	if len(r.opts.From) > 0 {
+		r.fromChannelId, err = r.filterChannels(ctx, r.opts.From)
+		if err != nil {
+			return err
+		}
+		if len(r.fromChannelId) == 0 {
+			return fmt.Errorf("no source nodes/channels selected, check if the ID is correct and node is online")
+		}
+	}
+	if len(r.opts.To) > 0 {
+		r.toChannelId, err = r.filterChannels(ctx, r.opts.To)
+		if err != nil {
+			return err
+		}
+		if len(r.toChannelId) == 0 {
+			return fmt.Errorf("no target nodes/channels selected, check if the ID is correct and node is online")
+		}
+	}
+	r.excludeFrom, err = r.filterChannels(ctx, r.opts.ExcludeFrom)
+	if err != nil {
+		return err
+	}
+	r.excludeTo, err = r.filterChannels(ctx, r.opts.ExcludeTo)
+	if err != nil {
+		return err
+	}
+	r.excludeBoth, r.excludeNodes, err = parseNodeChannelIDs(r.opts.Exclude)
+	if err != nil {
+		return fmt.Errorf("error parsing excluded node/channel list: %s", err)
+	}
+	return nil
+}
+
+// SaveNodeCache saves the node cache if the file is set in the options
+func (r *Rebalancer) SaveNodeCache() error {
+	return r.saveNodeCache(r.opts.NodeCacheFilename, r.opts.NodeCacheLifetime)
+}
+
+// SaveChanCache saves the channel cache if the file is set in the options
+func (r *Rebalancer) SaveChanCache() error {
+	return r.saveChanCache(r.opts.ChanCacheFilename, r.opts.ChanCacheLifetime)
+}
+
+// SaveCostBasis applies the rebalances and forwards made since the session
+// started to the saved cost basis if it's tracked
+func (r *Rebalancer) SaveCostBasis(ctx context.Context) error {
+	if r.costBasis == nil {
+		return nil
+	}
+	return r.syncCostBasis(ctx)
+}
+
+// Rebalance tries rebalancing until it succeeds, the goal is reached or the
+// session times out, ErrTimeout is returned in the latter case
+func (r *Rebalancer) Rebalance(ctx context.Context) (result Result, err error) {
+	if r.candidatesErr != nil {
+		return result, fmt.Errorf("error choosing channels: %s", r.candidatesErr)
+	}
+	if len(r.fromChannels) == 0 {
+		return result, fmt.Errorf("no source channels selected")
+	}
+	if len(r.toChannels) == 0 {
+		return result, fmt.Errorf("no target channels selected")
+	}
+	mainCtx, mainCtxCancel := context.WithTimeout(ctx, time.Minute*time.Duration(r.opts.TimeoutRebalance))
+	defer mainCtxCancel()
+	attempt := 1
+	for {
+		var retry bool
+		err, retry = r.tryRebalance(mainCtx, &attempt)
+		if mainCtx.Err() == context.DeadlineExceeded {
+			r.log(format.Err("Rebalancing timed out"))
+			err = ErrTimeout
+			break
+		}
+		if !retry {
+			if r.pairsExhausted(err) {
+				r.log(format.Info("No channel pairs left, ending the session"))
+				err = nil
+				break
+			}
+			if err != nil || r.goal == nil && !r.multiSession() {
+				break
+			}
+			r.rebalances++
+			var done bool
+			if r.goal != nil {
+				done, err = r.checkGoal(mainCtx)
+				if err != nil {
+					r.errorf("Error checking goal: %s", err)
+					break
+				}
+			} else {
+				done, err = r.checkTotal(mainCtx)
+				if r.pairsExhausted(err) {
+					r.log(format.Info("No channel pairs left, ending the session"))
+					err = nil
+					break
+				}
+				if err != nil {
+					r.errorf("Error refreshing channels: %s", err)
+					break
+				}
+			}
+			if done {
+				break
+			}
+		}
+	}
+	if r.opts.LoopOutFallback && r.successfulAmt == 0 && err != nil {
+		swapCtx, swapCtxCancel := context.WithTimeout(ctx, time.Second*time.Duration(r.opts.TimeoutInfo))
+		defer swapCtxCancel()
+		resp, swapErr := r.fallbackToSwap(swapCtx)
+		if swapErr != nil {
+			r.errorf("Loop out fallback failed: %s", swapErr)
+		} else {
+			result.Swap = resp
+			err = nil
+		}
+	}
+	result.AmountSat = r.successfulAmt
+	result.FeesMsat = r.paidFeesMsat
+	result.Payments = r.payments
+	result.Attempts = attempt
+	result.GoalReached = r.goal != nil && r.goal.reached
+	result.Pairs = r.pairSummaries(ctx)
+	return result, err
+}
@@ -0,0 +1,125 @@
+package rebalancer
+
+import (
+	"context"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rkfg/regolancer/format"
+)
+
+// splitPayment sums up the chunks of a split rebalance so that they're
+// reported as one payment
+type splitPayment struct {
+	from, to uint64
+	amount   int64
+	feeMsat  int64
+	payments int
+}
+
+// policyMaxHtlcMsat returns the max HTLC of the node policy for the channel,
+// zero if it's not set
+func (r *Rebalancer) policyMaxHtlcMsat(ctx context.Context, chanId uint64, node string) (int64, error) {
+	edge, err := r.getChanInfo(ctx, chanId)
+	if err != nil {
+		return 0, err
+	}
+	policy := edge.Node1Policy
+	if edge.Node2Pub == node {
+		policy = edge.Node2Policy
+	}
+	if policy == nil {
+		return 0, nil
+	}
+	return int64(policy.MaxHtlcMsat), nil
+}
+
+// routeAmount caps the amount to query routes for by max_htlc of our source
+// channel policy and the target peer policy, lnd doesn't return routes that
+// can't carry the whole amount in one HTLC so the larger amounts are split
+// over the route found
+func (r *Rebalancer) routeAmount(ctx context.Context, from, to uint64, amt int64) int64 {
+	type sender struct {
+		chanId uint64
+		node   string
+	}
+	senders := []sender{}
+	if from != 0 {
+		senders = append(senders, sender{chanId: from, node: r.myPK})
+	}
+	if c := r.findChannel(to); c != nil {
+		senders = append(senders, sender{chanId: to, node: c.RemotePubkey})
+	}
+	for _, s := range senders {
+		maxHtlcMsat, err := r.policyMaxHtlcMsat(ctx, s.chanId, s.node)
+		if err == nil && maxHtlcMsat >= 1000 {
+			amt = min(amt, maxHtlcMsat/1000)
+		}
+	}
+	return amt
+}
+
+// splitAmount splits the amount into chunks not exceeding the max chunk size
+func splitAmount(amt, maxChunk int64) []int64 {
+	result := []int64{}
+	for amt > 0 {
+		chunk := min(amt, maxChunk)
+		result = append(result, chunk)
+		amt -= chunk
+	}
+	return result
+}
+
+// trySplitRoute pays the amount over the route in chunks not exceeding the
+// smallest max_htlc on the route, every chunk fee is checked against the fee
+// limit proportional to maxFeeMsat calculated for the route amount. The paid
+// chunks are reported as one rebalance even if not all of them succeeded.
+func (r *Rebalancer) trySplitRoute(attemptCtx context.Context, route *lnrpc.Route, amt int64, maxFeeMsat int64,
+	attempt *int) bool {
+	routeAmt := (route.TotalAmtMsat - route.TotalFeesMsat) / 1000
+	capMsat, err := r.maxAmountOnRoute(attemptCtx, route)
+	if err != nil {
+		r.errorf("Error getting max amount on route: %s", err)
+		*attempt++
+		return false
+	}
+	chunkAmt := min(amt, int64(capMsat/1000))
+	if chunkAmt <= 0 {
+		r.errorf("Max amount on route %s msat is too small to split %s", format.HiWhite(capMsat), format.HiWhite(amt))
+		*attempt++
+		return false
+	}
+	chunks := splitAmount(amt, chunkAmt)
+	r.logf("Attempt %s, amount: %s in %s payments of up to %s (max fee: %s sat | %s ppm )",
+		format.HiWhiteF("#%d", *attempt), format.HiWhite(amt), format.HiWhite(len(chunks)), format.HiWhite(chunks[0]),
+		format.Fee(maxFeeMsat*amt/routeAmt), format.FeePPM(routeAmt*1000, maxFeeMsat))
+	r.reportRoute(attemptCtx, route)
+	split := &splitPayment{from: getSource(route), to: getTarget(route)}
+	for i, chunk := range chunks {
+		chunkRoute, err := r.rebuildRoute(attemptCtx, route, chunk)
+		if err != nil {
+			r.errorf("Error rebuilding the route for payment %d: %s", i+1, err)
+			break
+		}
+		// the goal fee budget isn't updated until the split rebalance is
+		// recorded so the chunks paid so far are accounted here
+		chunkMaxFeeMsat := r.goalFeeLimitMsat(maxFeeMsat*chunk/routeAmt+split.feeMsat) - split.feeMsat
+		err = r.pay(attemptCtx, chunk, 0, chunkMaxFeeMsat, chunkRoute, 0, split)
+		if err != nil {
+			r.invalidateInvoice(chunk)
+			r.errorf("Payment %d of %d failed: %s", i+1, len(chunks), err)
+			break
+		}
+	}
+	if split.amount == 0 {
+		*attempt++
+		return false
+	}
+	r.logf("Split rebalance finished, %s payments moved %s of %s, total fee: %s sat | %s ppm",
+		format.HiWhite(split.payments), format.HiWhite(split.amount), format.HiWhite(amt), format.Fee(split.feeMsat),
+		format.FeePPM(split.amount*1000, split.feeMsat))
+	err = r.recordPayment(split.from, split.to, split.amount, split.feeMsat)
+	if err != nil {
+		r.errorf("%s", err)
+	}
+	return true
+}
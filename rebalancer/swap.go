@@ -0,0 +1,235 @@
+package rebalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rkfg/regolancer/format"
+	"google.golang.org/protobuf/proto"
+)
+
+type LoopOutQuote struct {
+	SwapFeeSat      int64 `json:"swap_fee_sat,string"`
+	PrepayAmtSat    int64 `json:"prepay_amt_sat,string"`
+	HtlcSweepFeeSat int64 `json:"htlc_sweep_fee_sat,string"`
+}
+
+type LoopInQuote struct {
+	SwapFeeSat        int64 `json:"swap_fee_sat,string"`
+	HtlcPublishFeeSat int64 `json:"htlc_publish_fee_sat,string"`
+}
+
+type LoopOutRequest struct {
+	Amt                 int64    `json:"amt,string"`
+	OutgoingChanSet     []string `json:"outgoing_chan_set"`
+	MaxSwapFee          int64    `json:"max_swap_fee,string"`
+	MaxPrepayAmt        int64    `json:"max_prepay_amt,string"`
+	MaxMinerFee         int64    `json:"max_miner_fee,string"`
+	MaxSwapRoutingFee   int64    `json:"max_swap_routing_fee,string"`
+	MaxPrepayRoutingFee int64    `json:"max_prepay_routing_fee,string"`
+	Initiator           string   `json:"initiator"`
+}
+
+type LoopOutResponse struct {
+	Id          string `json:"id"`
+	HtlcAddress string `json:"htlc_address"`
+}
+
+// SwapClient is the subset of the Loop daemon API used for the swap fallback
+// and the advisor, amounts are in sats
+type SwapClient interface {
+	LoopOutQuote(ctx context.Context, amt int64) (*LoopOutQuote, error)
+	LoopOut(ctx context.Context, req *LoopOutRequest) (*LoopOutResponse, error)
+	LoopInQuote(ctx context.Context, amt int64) (*LoopInQuote, error)
+}
+
+// loopClient talks to loopd using its REST API so we don't depend on the Loop
+// module and its dependencies
+type loopClient struct {
+	baseURL  string
+	macaroon string
+	client   *http.Client
+}
+
+// NewLoopClient connects to loopd REST API at host:port
+func NewLoopClient(address, tlsCert, macaroonPath string) (SwapClient, error) {
+	cert, err := os.ReadFile(tlsCert)
+	if err != nil {
+		return nil, fmt.Errorf("error reading loop tls certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(cert) {
+		return nil, fmt.Errorf("error parsing loop tls certificate %s", tlsCert)
+	}
+	mac, err := os.ReadFile(macaroonPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading loop macaroon: %s", err)
+	}
+	return &loopClient{
+		baseURL:  "https://" + address,
+		macaroon: hex.EncodeToString(mac),
+		client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}},
+	}, nil
+}
+
+func (c *loopClient) call(ctx context.Context, method, path string, req, resp any) error {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Grpc-Metadata-macaroon", c.macaroon)
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	data, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("loopd returned %s: %s", httpResp.Status, data)
+	}
+	return json.Unmarshal(data, resp)
+}
+
+func (c *loopClient) LoopOutQuote(ctx context.Context, amt int64) (*LoopOutQuote, error) {
+	result := &LoopOutQuote{}
+	return result, c.call(ctx, http.MethodGet, fmt.Sprintf("/v1/loop/out/quote/%d", amt), nil, result)
+}
+
+func (c *loopClient) LoopOut(ctx context.Context, req *LoopOutRequest) (*LoopOutResponse, error) {
+	result := &LoopOutResponse{}
+	return result, c.call(ctx, http.MethodPost, "/v1/loop/out", req, result)
+}
+
+func (c *loopClient) LoopInQuote(ctx context.Context, amt int64) (*LoopInQuote, error) {
+	result := &LoopInQuote{}
+	return result, c.call(ctx, http.MethodGet, fmt.Sprintf("/v1/loop/in/quote/%d", amt), nil, result)
+}
+
+// DefaultLoopPath returns the path to the file in the default loopd directory
+func DefaultLoopPath(network, filename string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filename
+	}
+	return filepath.Join(home, ".loop", network, filename)
+}
+
+func (r *Rebalancer) fallbackToSwap(ctx context.Context) (*LoopOutResponse, error) {
+	r.log(format.Info("No rebalance succeeded, trying loop out"))
+	return r.trySwap(ctx, r.swap, r.opts.LoopOutMaxPPM)
+}
+
+// recordCheapestRoute queries the routes again without the fee limit if none
+// were found within it, the cheapest one is what a rebalance would cost and
+// it's compared with the swap cost later
+func (r *Rebalancer) recordCheapestRoute(ctx context.Context, req *lnrpc.QueryRoutesRequest) {
+	if !r.opts.LoopOutFallback {
+		return
+	}
+	req = proto.Clone(req).(*lnrpc.QueryRoutesRequest)
+	req.FeeLimit = nil
+	routes, err := r.lnClient.QueryRoutes(ctx, req)
+	if err != nil {
+		return
+	}
+	for _, route := range routes.Routes {
+		r.recordRouteFee(route.TotalAmtMsat-route.TotalFeesMsat, route.TotalFeesMsat)
+	}
+}
+
+// recordRouteFee remembers the cheapest route that was rejected for its fee
+// during the session to compare it with the swap cost later
+func (r *Rebalancer) recordRouteFee(amtMsat int64, feeMsat int64) {
+	if amtMsat <= 0 {
+		return
+	}
+	ppm := feeMsat * 1e6 / amtMsat
+	if r.cheapestRoutePPM == 0 || ppm < r.cheapestRoutePPM {
+		r.cheapestRoutePPM = ppm
+	}
+}
+
+// swapSource picks the source channel with the most local balance
+func (r *Rebalancer) swapSource() (chanId uint64, amount int64) {
+	for _, c := range r.fromChannels {
+		maxFrom := c.LocalBalance - c.Capacity/2
+		if r.opts.RelAmountFrom > 0 {
+			maxFrom = int64(float64(c.Capacity)*r.opts.RelAmountFrom) - c.RemoteBalance
+		}
+		if r.opts.Amount > 0 {
+			maxFrom = min(maxFrom, r.opts.Amount)
+		}
+		if maxFrom > amount {
+			chanId = c.ChanId
+			amount = maxFrom
+		}
+	}
+	return
+}
+
+// trySwap does a Loop Out from the source channel if circular rebalance
+// failed, the swap moves the local balance out the same way a rebalance would
+// do but the sats end up on chain
+func (r *Rebalancer) trySwap(ctx context.Context, swap SwapClient, maxPPM int64) (*LoopOutResponse, error) {
+	from, amt := r.swapSource()
+	if amt <= 0 {
+		return nil, fmt.Errorf("no source channel to swap from")
+	}
+	quote, err := swap.LoopOutQuote(ctx, amt)
+	if err != nil {
+		return nil, fmt.Errorf("error getting loop out quote: %s", err)
+	}
+	costMsat := (quote.SwapFeeSat + quote.HtlcSweepFeeSat) * 1000
+	maxCostMsat := amt * maxPPM / 1000
+	r.logf("Loop out quote for %s sat from channel %s: %s sat | %s ppm (max %s ppm)", format.Amt(amt), format.HiWhite(from),
+		format.Fee(costMsat), format.FeePPM(amt*1000, costMsat), format.HiWhite(maxPPM))
+	if costMsat > maxCostMsat {
+		return nil, fmt.Errorf("swap is too expensive")
+	}
+	if r.cheapestRoutePPM > 0 && r.cheapestRoutePPM <= costMsat*1000/amt {
+		return nil, fmt.Errorf("the cheapest rebalance route found costs %d ppm which is less than the swap", r.cheapestRoutePPM)
+	}
+	// whatever is left from the max cost can be spent on routing the swap and
+	// prepay payments
+	routingFee := (maxCostMsat - costMsat) / 1000
+	prepayRoutingFee := routingFee * quote.PrepayAmtSat / amt
+	resp, err := swap.LoopOut(ctx, &LoopOutRequest{
+		Amt:                 amt,
+		OutgoingChanSet:     []string{strconv.FormatUint(from, 10)},
+		MaxSwapFee:          quote.SwapFeeSat,
+		MaxPrepayAmt:        quote.PrepayAmtSat,
+		MaxMinerFee:         quote.HtlcSweepFeeSat,
+		MaxSwapRoutingFee:   routingFee - prepayRoutingFee,
+		MaxPrepayRoutingFee: prepayRoutingFee,
+		Initiator:           "regolancer",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error starting loop out: %s", err)
+	}
+	r.logf("Loop out %s started, htlc address: %s", format.Info(resp.Id), format.Info(resp.HtlcAddress))
+	return resp, nil
+}
@@ -0,0 +1,197 @@
+package rebalancer
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+)
+
+// fakeLoopd serves the loopd REST endpoints used by the swap client
+type fakeLoopd struct {
+	*httptest.Server
+	quote    LoopOutQuote
+	macaroon string
+	requests []LoopOutRequest
+}
+
+func newFakeLoopd(t *testing.T, quote LoopOutQuote) *fakeLoopd {
+	f := &fakeLoopd{quote: quote}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f.macaroon = req.Header.Get("Grpc-Metadata-macaroon")
+		switch {
+		case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/v1/loop/out/quote/"):
+			json.NewEncoder(w).Encode(f.quote)
+		case req.Method == http.MethodPost && req.URL.Path == "/v1/loop/out":
+			var loopReq LoopOutRequest
+			if err := json.NewDecoder(req.Body).Decode(&loopReq); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			f.requests = append(f.requests, loopReq)
+			json.NewEncoder(w).Encode(LoopOutResponse{Id: "swap1", HtlcAddress: "bc1qhtlc"})
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// client connects to the fake loopd the same way regolancer connects to the
+// real one, with the TLS certificate and macaroon files
+func (f *fakeLoopd) client(t *testing.T) SwapClient {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.cert")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.Certificate().Raw})
+	if err := os.WriteFile(certPath, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	macPath := filepath.Join(dir, "loop.macaroon")
+	if err := os.WriteFile(macPath, []byte{1, 2, 3}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewLoopClient(strings.TrimPrefix(f.URL, "https://"), certPath, macPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func swapRebalancer(cheapestRoutePPM int64) *Rebalancer {
+	return &Rebalancer{
+		opts: Options{Amount: 1_000_000},
+		fromChannels: []*lnrpc.Channel{
+			{ChanId: 1, Capacity: 4_000_000, LocalBalance: 3_000_000, RemoteBalance: 1_000_000},
+		},
+		cheapestRoutePPM: cheapestRoutePPM,
+	}
+}
+
+// 2000 sat swap fee and 1000 sat sweep fee for 1M sat is 3000 ppm
+var testQuote = LoopOutQuote{SwapFeeSat: 2000, PrepayAmtSat: 10_000, HtlcSweepFeeSat: 1000}
+
+func TestTrySwap(t *testing.T) {
+	quote := testQuote
+	tests := []struct {
+		name             string
+		maxPPM           int64
+		cheapestRoutePPM int64
+		err              string
+		routingFee       int64
+	}{
+		{name: "within budget", maxPPM: 5000, routingFee: 2000},
+		{name: "exact budget", maxPPM: 3000, routingFee: 0},
+		{name: "too expensive", maxPPM: 2999, err: "swap is too expensive"},
+		{name: "rebalance is cheaper", maxPPM: 5000, cheapestRoutePPM: 2500, err: "cheapest rebalance route"},
+		{name: "rebalance is more expensive", maxPPM: 5000, cheapestRoutePPM: 3500, routingFee: 2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loopd := newFakeLoopd(t, quote)
+			resp, err := swapRebalancer(tt.cheapestRoutePPM).trySwap(context.Background(), loopd.client(t), tt.maxPPM)
+			if loopd.macaroon != hex.EncodeToString([]byte{1, 2, 3}) {
+				t.Fatalf("unexpected macaroon %q", loopd.macaroon)
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				if len(loopd.requests) > 0 {
+					t.Fatalf("loop out started: %+v", loopd.requests)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Id != "swap1" || len(loopd.requests) != 1 {
+				t.Fatalf("unexpected response %+v, requests %+v", resp, loopd.requests)
+			}
+			req := loopd.requests[0]
+			if req.Amt != 1_000_000 || len(req.OutgoingChanSet) != 1 || req.OutgoingChanSet[0] != "1" {
+				t.Fatalf("unexpected swap %+v", req)
+			}
+			if req.MaxSwapFee != quote.SwapFeeSat || req.MaxMinerFee != quote.HtlcSweepFeeSat ||
+				req.MaxPrepayAmt != quote.PrepayAmtSat {
+				t.Fatalf("quote limits not passed: %+v", req)
+			}
+			if routingFee := req.MaxSwapRoutingFee + req.MaxPrepayRoutingFee; routingFee != tt.routingFee {
+				t.Fatalf("routing fee limit %d, expected %d", routingFee, tt.routingFee)
+			}
+		})
+	}
+}
+
+// routesClient finds a route only if it's queried without the fee limit
+type routesClient struct {
+	forwardsClient
+	route *lnrpc.Route
+}
+
+func (c *routesClient) QueryRoutes(ctx context.Context, in *lnrpc.QueryRoutesRequest,
+	opts ...grpc.CallOption) (*lnrpc.QueryRoutesResponse, error) {
+	if in.FeeLimit != nil {
+		return nil, errors.New("unable to find a path to destination")
+	}
+	return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{c.route}}, nil
+}
+
+func TestSwapComparedToUnlimitedRoute(t *testing.T) {
+	tests := []struct {
+		name     string
+		feeMsat  int64
+		fallback bool
+		ppm      int64
+		err      string
+	}{
+		{name: "rebalance is cheaper", feeMsat: 2_500_000, fallback: true, ppm: 2500, err: "cheapest rebalance route"},
+		{name: "rebalance is more expensive", feeMsat: 3_500_000, fallback: true, ppm: 3500},
+		{name: "fallback disabled", feeMsat: 2_500_000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := forwardsRebalancer(nil, 1, 2)
+			r.opts = Options{Amount: 1_000_000, FeeLimitPPM: 1000, TimeoutRoute: 30, LoopOutFallback: tt.fallback,
+				ChanCacheLifetime: 60}
+			r.fromChannels = swapRebalancer(0).fromChannels
+			r.lnClient = &routesClient{route: &lnrpc.Route{TotalAmtMsat: 1_000_000_000 + tt.feeMsat,
+				TotalFeesMsat: tt.feeMsat}}
+			if _, _, err := r.getRoutes(context.Background(), 1, 2, 1_000_000_000); err == nil {
+				t.Fatal("route found within the fee limit")
+			}
+			if r.cheapestRoutePPM != tt.ppm {
+				t.Fatalf("cheapest route %d ppm, expected %d ppm", r.cheapestRoutePPM, tt.ppm)
+			}
+			loopd := newFakeLoopd(t, testQuote)
+			_, err := r.trySwap(context.Background(), loopd.client(t), 5000)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil || len(loopd.requests) != 1 {
+				t.Fatalf("swap not started: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoopClientError(t *testing.T) {
+	loopd := newFakeLoopd(t, LoopOutQuote{})
+	_, err := loopd.client(t).LoopInQuote(context.Background(), 1000)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
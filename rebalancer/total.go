@@ -0,0 +1,114 @@
+package rebalancer
+
+import (
+	"context"
+	"time"
+
+	"github.com/rkfg/regolancer/format"
+)
+
+// PairSummary sums up the rebalances between the source and target channels
+// in this session
+type PairSummary struct {
+	From      uint64
+	To        uint64
+	FromAlias string
+	ToAlias   string
+	AmountSat int64
+	FeesMsat  int64
+	Payments  int
+}
+
+// multiSession is true if the session continues after a successful rebalance
+// until the total amount or the rebalance count limit is reached
+func (r *Rebalancer) multiSession() bool {
+	return r.opts.TotalAmount > 0 || r.opts.MaxRebalances > 0
+}
+
+// pairsExhausted reports if the session with the total amount or the rebalance
+// count limit ran out of channel pairs after some rebalances succeeded, it's
+// the natural end of such session and not an error
+func (r *Rebalancer) pairsExhausted(err error) bool {
+	return r.multiSession() && r.rebalances > 0 && (err == errNoPairs || err == errNoRoutes)
+}
+
+// totalRemaining returns how many sats are left to move in this session, it's
+// only meaningful if the total amount is set
+func (r *Rebalancer) totalRemaining() int64 {
+	return r.opts.TotalAmount - r.successfulAmt
+}
+
+// rebalanceAmount is the amount of the next rebalance capped by the remaining
+// total amount, zero means the amount is calculated from the channel balances
+func (r *Rebalancer) rebalanceAmount() int64 {
+	if r.opts.TotalAmount == 0 {
+		return r.opts.Amount
+	}
+	if r.opts.Amount == 0 {
+		return r.totalRemaining()
+	}
+	return min(r.opts.Amount, r.totalRemaining())
+}
+
+// checkTotal reports if the total amount or the rebalance count limit is
+// reached, otherwise the channels are refreshed and the candidates are
+// recalculated for the next rebalance
+func (r *Rebalancer) checkTotal(ctx context.Context) (done bool, err error) {
+	r.logf("Rebalances done: %s, moved %s sat so far, paid %s sat in fees", format.HiWhite(r.rebalances),
+		format.Amt(r.successfulAmt), format.Fee(r.paidFeesMsat))
+	if r.opts.MaxRebalances > 0 && r.rebalances >= r.opts.MaxRebalances {
+		r.log(format.Info("Max rebalances reached"))
+		return true, nil
+	}
+	if r.opts.TotalAmount > 0 {
+		remaining := r.totalRemaining()
+		if remaining <= 0 || remaining < r.opts.MinAmount {
+			r.log(format.Info("Total amount reached"))
+			return true, nil
+		}
+	}
+	err = r.getChannels(ctx)
+	if err != nil {
+		return false, err
+	}
+	return false, r.refreshCandidates(r.fromChannelId, r.toChannelId)
+}
+
+// addPairSummary accounts the payment in the pair summary
+func (r *Rebalancer) addPairSummary(from, to uint64, amount int64, feeMsat int64) {
+	key := [2]uint64{from, to}
+	idx, ok := r.pairSummaryIdx[key]
+	if !ok {
+		idx = len(r.pairSummary)
+		r.pairSummaryIdx[key] = idx
+		r.pairSummary = append(r.pairSummary, PairSummary{From: from, To: to})
+	}
+	s := &r.pairSummary[idx]
+	s.AmountSat += amount
+	s.FeesMsat += feeMsat
+	s.Payments++
+}
+
+// pairSummaries returns the pair summaries in the order of the first payment
+// with the peer aliases if they're available
+func (r *Rebalancer) pairSummaries(ctx context.Context) []PairSummary {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(r.opts.TimeoutInfo))
+	defer cancel()
+	alias := func(chanId uint64) string {
+		c := r.findChannel(chanId)
+		if c == nil {
+			return ""
+		}
+		nodeInfo, err := r.getNodeInfo(ctx, c.RemotePubkey)
+		if err != nil {
+			return ""
+		}
+		return nodeInfo.Node.Alias
+	}
+	result := append([]PairSummary{}, r.pairSummary...)
+	for i := range result {
+		result[i].FromAlias = alias(result[i].From)
+		result[i].ToAlias = alias(result[i].To)
+	}
+	return result
+}
@@ -0,0 +1,265 @@
+// Package recorder saves the lnd gRPC calls made by regolancer to a file and
+// replays them later without a node so that a session can be reproduced
+// exactly. The file has one JSON object per line, the first one is the header
+// with the random seed and the start time of the session and the others are
+// the calls with the time they were made and the protobuf messages encoded as
+// JSON. The responses are also saved in the binary form because JSON loses the
+// fields unknown to our lnrpc version (like the inbound fees).
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+type header struct {
+	Seed int64 `json:"seed"`
+	// Time is in unix nanoseconds
+	Time int64 `json:"time,omitempty"`
+}
+
+type call struct {
+	Method      string          `json:"method"`
+	Time        int64           `json:"time,omitempty"`
+	Request     json.RawMessage `json:"request"`
+	Response    json.RawMessage `json:"response,omitempty"`
+	ResponseRaw []byte          `json:"response_raw,omitempty"`
+	Code        codes.Code      `json:"code,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// marshal encodes the message in compact form, protojson output isn't stable
+// on purpose so it has to be normalized to compare requests
+func marshal(msg any) (json.RawMessage, error) {
+	pm, ok := msg.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", msg)
+	}
+	data, err := protojson.Marshal(pm)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = json.Compact(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Recorder is a gRPC connection that passes the calls to the real connection
+// and saves them to the file, streams are passed through without recording
+type Recorder struct {
+	conn grpc.ClientConnInterface
+	mu   sync.Mutex
+	f    *os.File
+	enc  *json.Encoder
+	err  error
+}
+
+// NewRecorder creates the recording file and writes the header with the seed
+// that should be used for the session
+func NewRecorder(conn grpc.ClientConnInterface, filename string, seed int64) (*Recorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{conn: conn, f: f, enc: json.NewEncoder(f)}
+	err = r.enc.Encode(header{Seed: seed, Time: time.Now().UnixNano()})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) Invoke(ctx context.Context, method string, args any, reply any,
+	opts ...grpc.CallOption) error {
+	c := call{Method: method, Time: time.Now().UnixNano()}
+	err := r.conn.Invoke(ctx, method, args, reply, opts...)
+	var recErr error
+	c.Request, recErr = marshal(args)
+	if err != nil {
+		st := status.Convert(err)
+		c.Code = st.Code()
+		c.Error = st.Message()
+	} else if recErr == nil {
+		c.Response, recErr = marshal(reply)
+		if recErr == nil {
+			c.ResponseRaw, recErr = proto.Marshal(reply.(proto.Message))
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if recErr == nil {
+		recErr = r.enc.Encode(c)
+	}
+	if recErr != nil && r.err == nil {
+		r.err = fmt.Errorf("error recording %s: %s", method, recErr)
+	}
+	return err
+}
+
+// NewStream passes the streaming calls through without recording them, the
+// commands that need streams are refused before the session starts
+func (r *Recorder) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string,
+	opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return r.conn.NewStream(ctx, desc, method, opts...)
+}
+
+// Close closes the file and returns the first recording error if any
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.f.Close()
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
+
+// Replayer is a gRPC connection that answers the calls from a recording. Every
+// recorded call is used once, the first unused call with the same method and
+// request is preferred. If there's none, the first unused call with the same
+// method is taken and reported to Warn because the response was made for a
+// different request and the session has most likely diverged.
+type Replayer struct {
+	// Warn is called when a call is answered with the response to a different
+	// request, the replayer is locked during the call
+	Warn       func(msg string)
+	mu         sync.Mutex
+	seed       int64
+	now        int64
+	calls      []call
+	used       []bool
+	mismatches int
+}
+
+// NewReplayer loads the recording
+func NewReplayer(filename string) (*Replayer, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	var h header
+	err = dec.Decode(&h)
+	if err != nil {
+		return nil, fmt.Errorf("error reading recording header: %s", err)
+	}
+	r := &Replayer{seed: h.Seed, now: h.Time}
+	for dec.More() {
+		var c call
+		err = dec.Decode(&c)
+		if err != nil {
+			return nil, fmt.Errorf("error reading recorded call %d: %s", len(r.calls)+1, err)
+		}
+		r.calls = append(r.calls, c)
+	}
+	r.used = make([]bool, len(r.calls))
+	return r, nil
+}
+
+// Seed returns the random seed of the recorded session
+func (r *Replayer) Seed() int64 {
+	return r.seed
+}
+
+// Now returns the time of the last replayed call (or the session start) so
+// that the failed pairs and cached edges expire the same way they did during
+// the recording, old recordings without the time use the current time
+func (r *Replayer) Now() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.now == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, r.now)
+}
+
+// Mismatches returns the number of calls answered with the response to a
+// different request
+func (r *Replayer) Mismatches() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mismatches
+}
+
+// Left returns the number of recorded calls that weren't replayed
+func (r *Replayer) Left() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := 0
+	for _, used := range r.used {
+		if !used {
+			result++
+		}
+	}
+	return result
+}
+
+func (r *Replayer) Invoke(ctx context.Context, method string, args any, reply any,
+	opts ...grpc.CallOption) error {
+	req, err := marshal(args)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	idx, exact := -1, false
+	for i, c := range r.calls {
+		if r.used[i] || c.Method != method {
+			continue
+		}
+		if idx < 0 {
+			idx = i
+		}
+		if bytes.Equal(c.Request, req) {
+			idx, exact = i, true
+			break
+		}
+	}
+	if idx < 0 {
+		return status.Errorf(codes.Unavailable, "no recorded %s calls left to replay", method)
+	}
+	r.used[idx] = true
+	c := r.calls[idx]
+	if !exact {
+		r.mismatches++
+		if r.Warn != nil {
+			r.Warn(fmt.Sprintf("No recorded %s call with the same request, replaying the response to %s", method,
+				c.Request))
+		}
+	}
+	if c.Time > r.now {
+		r.now = c.Time
+	}
+	if c.Error != "" || c.Code != codes.OK {
+		return status.Error(c.Code, c.Error)
+	}
+	pm, ok := reply.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a protobuf message", reply)
+	}
+	if len(c.ResponseRaw) > 0 {
+		return proto.Unmarshal(c.ResponseRaw, pm)
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(c.Response, pm)
+}
+
+func (r *Replayer) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string,
+	opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, status.Errorf(codes.Unimplemented, "%s stream can't be replayed", method)
+}
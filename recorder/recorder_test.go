@@ -0,0 +1,103 @@
+package recorder
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeConn answers GetChanInfo with an edge that has a policy field unknown to
+// our lnrpc version
+type fakeConn struct{}
+
+func (fakeConn) Invoke(ctx context.Context, method string, args any, reply any, opts ...grpc.CallOption) error {
+	req := args.(*lnrpc.ChanInfoRequest)
+	policy := &lnrpc.RoutingPolicy{FeeRateMilliMsat: 100}
+	unknown := protowire.AppendTag(nil, 10, protowire.VarintType)
+	policy.ProtoReflect().SetUnknown(protowire.AppendVarint(unknown, 42))
+	proto.Merge(reply.(proto.Message), &lnrpc.ChannelEdge{ChannelId: req.ChanId, Node1Policy: policy})
+	return nil
+}
+
+func (fakeConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string,
+	opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, nil
+}
+
+func record(t *testing.T, chanIds ...uint64) string {
+	filename := filepath.Join(t.TempDir(), "rec.jsonl")
+	rec, err := NewRecorder(fakeConn{}, filename, 123)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := lnrpc.NewLightningClient(rec)
+	for _, id := range chanIds {
+		if _, err := client.GetChanInfo(context.Background(), &lnrpc.ChanInfoRequest{ChanId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReplay(t *testing.T) {
+	start := time.Now()
+	filename := record(t, 1, 2)
+	rep, err := NewReplayer(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Seed() != 123 {
+		t.Fatalf("seed %d", rep.Seed())
+	}
+	if rep.Now().Before(start) || rep.Now().After(time.Now()) {
+		t.Fatalf("replay clock %s is not the recording time", rep.Now())
+	}
+	warnings := 0
+	rep.Warn = func(msg string) { warnings++ }
+	client := lnrpc.NewLightningClient(rep)
+	// the calls are matched by the request, not by the order
+	for _, id := range []uint64{2, 1} {
+		edge, err := client.GetChanInfo(context.Background(), &lnrpc.ChanInfoRequest{ChanId: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edge.ChannelId != id {
+			t.Fatalf("got edge %d for request %d", edge.ChannelId, id)
+		}
+		if len(edge.Node1Policy.ProtoReflect().GetUnknown()) == 0 {
+			t.Fatal("unknown policy fields are lost")
+		}
+	}
+	if warnings != 0 || rep.Mismatches() != 0 || rep.Left() != 0 {
+		t.Fatalf("warnings %d, mismatches %d, left %d", warnings, rep.Mismatches(), rep.Left())
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	rep, err := NewReplayer(record(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings := 0
+	rep.Warn = func(msg string) { warnings++ }
+	client := lnrpc.NewLightningClient(rep)
+	edge, err := client.GetChanInfo(context.Background(), &lnrpc.ChanInfoRequest{ChanId: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edge.ChannelId != 1 || warnings != 1 || rep.Mismatches() != 1 {
+		t.Fatalf("edge %d, warnings %d, mismatches %d", edge.ChannelId, warnings, rep.Mismatches())
+	}
+	if _, err := client.GetChanInfo(context.Background(), &lnrpc.ChanInfoRequest{ChanId: 1}); err == nil {
+		t.Fatal("recorded call was replayed twice")
+	}
+}
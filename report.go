@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/mattn/go-runewidth"
+	"github.com/rkfg/regolancer/format"
+	"github.com/rkfg/regolancer/rebalancer"
+)
+
+func logErrorF(fmt string, args ...any) {
+	log.Print(format.ErrF(fmt, args...))
+}
+
+func logMessage(msg string) {
+	if msg == "" {
+		fmt.Println()
+		return
+	}
+	log.Print(msg)
+}
+
+func printRoute(route *lnrpc.Route, hops []rebalancer.HopInfo) {
+	errs := ""
+	fmt.Printf("%s %s sat | %s ppm\n", format.FaintWhite("Total fee:"),
+		format.Fee(route.TotalFeesMsat), format.FeePPM(route.TotalAmtMsat-route.TotalFeesMsat, route.TotalFeesMsat))
+	for i, hop := range hops {
+		cached := ""
+		if params.NodeCacheInfo {
+			cached = format.Err("x")
+			if hop.Cached {
+				cached = format.Cyan("x")
+			}
+			cached += "|"
+		}
+		if hop.Err != nil {
+			errs = errs + hop.Err.Error() + "\n"
+			continue
+		}
+		fee := format.HiWhiteF("%-6s", "")
+		if i > 0 {
+			fee = format.HiWhiteF("%-6d", route.Hops[i-1].FeeMsat)
+			if inbound := hops[i-1].InboundFeeMsat; inbound != 0 {
+				fee += format.FaintWhite(fmt.Sprintf(" (%+d inbound)", inbound))
+			}
+		}
+		fmt.Printf("%s %s [%s%s|%sch|%ssat|%s]\n", format.FaintWhite(hop.Hop.ChanId), fee, cached, format.Cyan(hop.Node.Node.Alias),
+			format.Info(hop.Node.NumChannels), format.Amt(hop.Node.TotalCapacity), format.Info(hop.Node.Node.PubKey))
+	}
+	if errs != "" {
+		fmt.Println(format.Err(errs))
+	}
+}
+
+func formatAdviceFee(amtMsat int64, feeMsat int64) string {
+	if feeMsat < 0 {
+		return format.FaintWhite("n/a")
+	}
+	return fmt.Sprintf("%s sat | %s ppm", format.Fee(feeMsat), format.FeePPM(amtMsat, feeMsat))
+}
+
+func printAdvice(advice *rebalancer.Advice) {
+	amtMsat := advice.AmountSat * 1000
+	sep := strings.Repeat("—", 98)
+	fmt.Printf("%s\nAmount: %s sat, open channel fee: %s, swap fee: %s\n%s\n", sep, format.Amt(advice.AmountSat),
+		formatAdviceFee(amtMsat, advice.OpenFeeMsat), formatAdviceFee(amtMsat, advice.SwapFeeMsat), sep)
+	for _, c := range advice.Channels {
+		printChannelInfo(c.ChannelInfo)
+		fmt.Printf("rebalance: %s => %s\n", formatAdviceFee(amtMsat, c.RebalanceFeeMsat),
+			format.HiWhite(c.Recommendation()))
+	}
+	fmt.Println(sep)
+	log.Printf("Rebalance fees are shown for the cheapest route within the fee limit")
+}
+
+func printProbeResult(result *rebalancer.ProbeResult) {
+	if result.AmountSat == 0 {
+		log.Print(format.Err("No amount can pass the route now"))
+		return
+	}
+	log.Printf("Max amount: %s sat, fee: %s sat | %s ppm", format.Amt(result.AmountSat), format.Fee(result.FeeMsat),
+		format.FeePPM(result.AmountSat*1000, result.FeeMsat))
+}
+
+func formatDuration(d time.Duration) string {
+	if d >= time.Hour*24 {
+		return fmt.Sprintf("%.1fd", d.Hours()/24)
+	}
+	return d.Round(time.Minute).String()
+}
+
+func printROI(report *rebalancer.ROIReport) {
+	sep := strings.Repeat("—", 98)
+	fmt.Println(sep)
+	for _, rb := range report.Rebalances {
+		used := "not used up yet"
+		if rb.UsedUp > 0 {
+			used = "used up in " + formatDuration(rb.UsedUp)
+		}
+		fmt.Printf("%s %s => %s: %s sat for %s sat, forwarded %s sat earning %s sat, %s\n",
+			rb.Timestamp.Format("2006-01-02 15:04"), format.HiWhite(rb.From),
+			format.HiWhite(rb.To), format.Amt(rb.AmountMsat/1000), format.Fee(rb.FeeMsat),
+			format.Amt(rb.LeftMsat/1000), format.Fee(rb.EarnedMsat), used)
+	}
+	fmt.Printf("%s\nRebalance ROI by target peer\n%s\n", sep, sep)
+	for _, p := range report.Peers {
+		alias := p.Alias
+		if alias == "" {
+			alias = "unknown"
+			if p.Pubkey != "" {
+				alias = p.Pubkey[:16]
+			}
+		}
+		alias = runewidth.FillRight(runewidth.Truncate(alias, 25, ""), 25)
+		profit := format.Fee(p.ProfitMsat())
+		if p.ProfitMsat() < 0 {
+			profit = format.ErrF("-%s", format.Fee(-p.ProfitMsat()))
+		}
+		payback := "never"
+		if p.PaidBack > 0 {
+			payback = formatDuration(p.AvgPayback)
+		}
+		fmt.Printf("%s %d rebalances, %s sat for %s sat | %s ppm, forwarded %s sat earning %s sat, profit %s sat, "+
+			"paid back %d/%d (avg %s)\n", alias, p.Rebalances, format.Amt(p.AmountMsat/1000), format.Fee(p.FeeMsat),
+			format.FeePPM(p.AmountMsat, p.FeeMsat), format.Amt(p.LeftMsat/1000), format.Fee(p.EarnedMsat), profit,
+			p.PaidBack, p.Rebalances, payback)
+	}
+	fmt.Println(sep)
+}
+
+func printPairSummary(result rebalancer.Result) {
+	if len(result.Pairs) == 0 {
+		log.Print("Nothing was rebalanced")
+		return
+	}
+	alias := func(chanId uint64, alias string) string {
+		if alias == "" {
+			alias = fmt.Sprint(chanId)
+		}
+		return runewidth.FillRight(runewidth.Truncate(alias, 20, ""), 20)
+	}
+	sep := strings.Repeat("—", 98)
+	fmt.Printf("%s\nRebalances by channel pair\n%s\n", sep, sep)
+	for _, p := range result.Pairs {
+		fmt.Printf("%s => %s %s payments, %s sat for %s sat | %s ppm\n", alias(p.From, p.FromAlias),
+			alias(p.To, p.ToAlias), format.HiWhite(p.Payments), format.Amt(p.AmountSat), format.Fee(p.FeesMsat),
+			format.FeePPM(p.AmountSat*1000, p.FeesMsat))
+	}
+	fmt.Println(sep)
+	log.Printf("Total: %s sat moved in %s payments, %s sat | %s ppm paid in fees", format.Amt(result.AmountSat),
+		format.HiWhite(result.Payments), format.Fee(result.FeesMsat), format.FeePPM(result.AmountSat*1000, result.FeesMsat))
+}
+
+func printDrainResult(chanId string, result rebalancer.Result) {
+	if result.AmountSat == 0 {
+		log.Print("Nothing was drained")
+		return
+	}
+	log.Printf("Drained %s sat from channel %s, total cost: %s sat | %s ppm", format.Amt(result.AmountSat),
+		format.HiWhite(chanId), format.Fee(result.FeesMsat), format.FeePPM(result.AmountSat*1000, result.FeesMsat))
+}
@@ -0,0 +1,202 @@
+package simulator
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+)
+
+type lightningClient struct {
+	lnrpc.LightningClient
+	n *Network
+}
+
+func (l *lightningClient) GetInfo(ctx context.Context, in *lnrpc.GetInfoRequest,
+	opts ...grpc.CallOption) (*lnrpc.GetInfoResponse, error) {
+	n := l.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return &lnrpc.GetInfoResponse{
+		IdentityPubkey:    n.self,
+		Alias:             n.nodes[n.self].Alias,
+		BlockHeight:       n.blockHeight,
+		NumActiveChannels: uint32(len(n.nodeChannels[n.self])),
+		SyncedToChain:     true,
+		SyncedToGraph:     true,
+	}, nil
+}
+
+func (n *Network) ownChannel(c *simChannel) *lnrpc.Channel {
+	peer := c.peer(n.self)
+	constraints := func(policy *lnrpc.RoutingPolicy) *lnrpc.ChannelConstraints {
+		result := &lnrpc.ChannelConstraints{
+			CsvDelay:          144,
+			ChanReserveSat:    uint64(c.reserveMsat() / 1000),
+			DustLimitSat:      354,
+			MaxPendingAmtMsat: uint64(c.edge.Capacity * 1000),
+			MaxAcceptedHtlcs:  483,
+		}
+		if policy != nil {
+			result.MinHtlcMsat = uint64(policy.MinHtlc)
+		}
+		return result
+	}
+	policy := c.policy(n.self)
+	return &lnrpc.Channel{
+		Active:            policy != nil && !policy.Disabled,
+		RemotePubkey:      peer,
+		ChannelPoint:      c.edge.ChanPoint,
+		ChanId:            c.edge.ChannelId,
+		Capacity:          c.edge.Capacity,
+		LocalBalance:      c.balance[c.side(n.self)] / 1000,
+		RemoteBalance:     c.balance[c.side(peer)] / 1000,
+		Initiator:         c.side(n.self) == 0,
+		LocalConstraints:  constraints(policy),
+		RemoteConstraints: constraints(c.policy(peer)),
+	}
+}
+
+func (l *lightningClient) ListChannels(ctx context.Context, in *lnrpc.ListChannelsRequest,
+	opts ...grpc.CallOption) (*lnrpc.ListChannelsResponse, error) {
+	n := l.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	peer := hex.EncodeToString(in.Peer)
+	result := &lnrpc.ListChannelsResponse{}
+	for _, c := range n.nodeChannels[n.self] {
+		channel := n.ownChannel(c)
+		if in.ActiveOnly && !channel.Active || in.InactiveOnly && channel.Active {
+			continue
+		}
+		if len(in.Peer) > 0 && channel.RemotePubkey != peer {
+			continue
+		}
+		result.Channels = append(result.Channels, channel)
+	}
+	return result, nil
+}
+
+func (l *lightningClient) GetChanInfo(ctx context.Context, in *lnrpc.ChanInfoRequest,
+	opts ...grpc.CallOption) (*lnrpc.ChannelEdge, error) {
+	n := l.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c, ok := n.channels[in.ChanId]
+	if !ok {
+		return nil, fmt.Errorf("edge not found")
+	}
+	return c.edge, nil
+}
+
+func (l *lightningClient) GetNodeInfo(ctx context.Context, in *lnrpc.NodeInfoRequest,
+	opts ...grpc.CallOption) (*lnrpc.NodeInfo, error) {
+	n := l.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	node, ok := n.nodes[in.PubKey]
+	if !ok {
+		return nil, fmt.Errorf("unable to find node")
+	}
+	result := &lnrpc.NodeInfo{Node: node, NumChannels: uint32(len(n.nodeChannels[in.PubKey]))}
+	for _, c := range n.nodeChannels[in.PubKey] {
+		result.TotalCapacity += c.edge.Capacity
+		if in.IncludeChannels {
+			result.Channels = append(result.Channels, c.edge)
+		}
+	}
+	return result, nil
+}
+
+func (l *lightningClient) DescribeGraph(ctx context.Context, in *lnrpc.ChannelGraphRequest,
+	opts ...grpc.CallOption) (*lnrpc.ChannelGraph, error) {
+	n := l.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	result := &lnrpc.ChannelGraph{}
+	for _, node := range n.nodes {
+		result.Nodes = append(result.Nodes, node)
+	}
+	for _, c := range n.channels {
+		result.Edges = append(result.Edges, c.edge)
+	}
+	return result, nil
+}
+
+func (l *lightningClient) QueryRoutes(ctx context.Context, in *lnrpc.QueryRoutesRequest,
+	opts ...grpc.CallOption) (*lnrpc.QueryRoutesResponse, error) {
+	n := l.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	amtMsat := in.AmtMsat
+	if amtMsat == 0 {
+		amtMsat = in.Amt * 1000
+	}
+	finalCltv := int64(in.FinalCltvDelta)
+	if finalCltv == 0 {
+		finalCltv = 40
+	}
+	path, err := n.findPath(in, amtMsat)
+	if err != nil {
+		return nil, err
+	}
+	route := n.buildRoute(path, amtMsat, finalCltv)
+	if in.FeeLimit != nil {
+		limitMsat := int64(-1)
+		switch limit := in.FeeLimit.Limit.(type) {
+		case *lnrpc.FeeLimit_FixedMsat:
+			limitMsat = limit.FixedMsat
+		case *lnrpc.FeeLimit_Fixed:
+			limitMsat = limit.Fixed * 1000
+		case *lnrpc.FeeLimit_Percent:
+			limitMsat = amtMsat * limit.Percent / 100
+		}
+		if limitMsat >= 0 && route.TotalFeesMsat > limitMsat {
+			return nil, fmt.Errorf("unable to find a path to destination")
+		}
+	}
+	return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{route}, SuccessProb: 1}, nil
+}
+
+func (l *lightningClient) AddInvoice(ctx context.Context, in *lnrpc.Invoice,
+	opts ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
+	n := l.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	preimage := make([]byte, 32)
+	paymentAddr := make([]byte, 32)
+	if _, err := rand.Read(preimage); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(paymentAddr); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(preimage)
+	valueMsat := in.ValueMsat
+	if valueMsat == 0 {
+		valueMsat = in.Value * 1000
+	}
+	n.invoices[hex.EncodeToString(hash[:])] = &simInvoice{preimage: preimage, valueMsat: valueMsat}
+	return &lnrpc.AddInvoiceResponse{RHash: hash[:], AddIndex: uint64(len(n.invoices)), PaymentAddr: paymentAddr}, nil
+}
+
+// ForwardingHistory returns no forwards, the simulated network doesn't route
+// payments of others
+func (l *lightningClient) ForwardingHistory(ctx context.Context, in *lnrpc.ForwardingHistoryRequest,
+	opts ...grpc.CallOption) (*lnrpc.ForwardingHistoryResponse, error) {
+	return &lnrpc.ForwardingHistoryResponse{LastOffsetIndex: in.IndexOffset}, nil
+}
+
+func (l *lightningClient) ClosedChannels(ctx context.Context, in *lnrpc.ClosedChannelsRequest,
+	opts ...grpc.CallOption) (*lnrpc.ClosedChannelsResponse, error) {
+	return &lnrpc.ClosedChannelsResponse{}, nil
+}
+
+func (l *lightningClient) CloseChannel(ctx context.Context, in *lnrpc.CloseChannelRequest,
+	opts ...grpc.CallOption) (lnrpc.Lightning_CloseChannelClient, error) {
+	return nil, fmt.Errorf("closing channels is not supported in simulation")
+}
@@ -0,0 +1,154 @@
+// Package simulator implements the subset of the lnd API used by regolancer on
+// top of a simulated network loaded from a JSON file. Channel liquidity is
+// tracked on both sides so payments succeed or fail the way they would on the
+// real network with the same balances.
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rkfg/regolancer/rebalancer"
+)
+
+type simChannel struct {
+	edge *lnrpc.ChannelEdge
+	// balances in msat on the node1 and node2 sides
+	balance [2]int64
+}
+
+// side returns 0 for node1, 1 for node2 and -1 if the node is not a channel
+// party
+func (c *simChannel) side(pubkey string) int {
+	switch pubkey {
+	case c.edge.Node1Pub:
+		return 0
+	case c.edge.Node2Pub:
+		return 1
+	}
+	return -1
+}
+
+func (c *simChannel) peer(pubkey string) string {
+	if pubkey == c.edge.Node1Pub {
+		return c.edge.Node2Pub
+	}
+	return c.edge.Node1Pub
+}
+
+// policy returns the policy the node applies to the HTLCs it sends through the
+// channel
+func (c *simChannel) policy(from string) *lnrpc.RoutingPolicy {
+	if from == c.edge.Node1Pub {
+		return c.edge.Node1Policy
+	}
+	return c.edge.Node2Policy
+}
+
+// reserveMsat is the channel reserve, 1% of the capacity like lnd uses by
+// default
+func (c *simChannel) reserveMsat() int64 {
+	return c.edge.Capacity * 10
+}
+
+func (c *simChannel) spendableMsat(from string) int64 {
+	return c.balance[c.side(from)] - c.reserveMsat()
+}
+
+// Network is the simulated network state, it's safe for concurrent use
+type Network struct {
+	mu           sync.Mutex
+	self         string
+	blockHeight  uint32
+	satPerKw     int64
+	nodes        map[string]*lnrpc.LightningNode
+	channels     map[uint64]*simChannel
+	nodeChannels map[string][]*simChannel
+	invoices     map[string]*simInvoice
+	// failed amounts per node pair like lnd mission control does
+	failures map[string]int64
+}
+
+type simInvoice struct {
+	preimage  []byte
+	valueMsat int64
+	settled   bool
+}
+
+// networkFile is the simulated network description, Graph is the output of
+// lncli describegraph and Liquidity has the node1 side balance in sats for
+// some channels, other channels get DefaultLiquidity fraction of the capacity
+// on the node1 side (0.5 if not set)
+type networkFile struct {
+	Self             string           `json:"self"`
+	BlockHeight      uint32           `json:"block_height"`
+	SatPerKw         int64            `json:"sat_per_kw"`
+	Graph            json.RawMessage  `json:"graph"`
+	Liquidity        map[string]int64 `json:"liquidity"`
+	DefaultLiquidity *float64         `json:"default_liquidity"`
+}
+
+// Load reads the simulated network from the file
+func Load(filename string) (*Network, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var nf networkFile
+	err = json.Unmarshal(data, &nf)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing network file: %s", err)
+	}
+	graph, err := rebalancer.ParseGraph(nf.Graph)
+	if err != nil {
+		return nil, err
+	}
+	n := &Network{
+		self:         nf.Self,
+		blockHeight:  nf.BlockHeight,
+		satPerKw:     nf.SatPerKw,
+		nodes:        map[string]*lnrpc.LightningNode{},
+		channels:     map[uint64]*simChannel{},
+		nodeChannels: map[string][]*simChannel{},
+		invoices:     map[string]*simInvoice{},
+		failures:     map[string]int64{},
+	}
+	if n.satPerKw == 0 {
+		n.satPerKw = 2500
+	}
+	defaultLiquidity := 0.5
+	if nf.DefaultLiquidity != nil {
+		defaultLiquidity = *nf.DefaultLiquidity
+	}
+	for _, node := range graph.Nodes {
+		n.nodes[node.PubKey] = node
+	}
+	if _, ok := n.nodes[n.self]; !ok {
+		return nil, fmt.Errorf("own node %s is not in the graph", n.self)
+	}
+	for _, edge := range graph.Edges {
+		node1Msat := int64(float64(edge.Capacity*1000) * defaultLiquidity)
+		if l, ok := nf.Liquidity[strconv.FormatUint(edge.ChannelId, 10)]; ok {
+			if l < 0 || l > edge.Capacity {
+				return nil, fmt.Errorf("invalid liquidity %d for channel %d with capacity %d", l, edge.ChannelId,
+					edge.Capacity)
+			}
+			node1Msat = l * 1000
+		}
+		c := &simChannel{edge: edge, balance: [2]int64{node1Msat, edge.Capacity*1000 - node1Msat}}
+		n.channels[edge.ChannelId] = c
+		n.nodeChannels[edge.Node1Pub] = append(n.nodeChannels[edge.Node1Pub], c)
+		n.nodeChannels[edge.Node2Pub] = append(n.nodeChannels[edge.Node2Pub], c)
+	}
+	return n, nil
+}
+
+// Lightning returns the lnd client, only the methods used by regolancer are
+// implemented, the others panic
+func (n *Network) Lightning() lnrpc.LightningClient {
+	return &lightningClient{n: n}
+}
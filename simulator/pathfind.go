@@ -0,0 +1,213 @@
+package simulator
+
+import (
+	"container/heap"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rkfg/regolancer/rebalancer"
+)
+
+// every hop costs this much on top of the fee so that shorter routes win
+const hopPenaltyMsat = 1000
+
+type pathEdge struct {
+	ch       *simChannel
+	from, to string
+}
+
+func (e pathEdge) policy() *lnrpc.RoutingPolicy {
+	return e.ch.policy(e.from)
+}
+
+type distItem struct {
+	node string
+	dist int64
+}
+
+type distHeap []distItem
+
+func (h distHeap) Len() int            { return len(h) }
+func (h distHeap) Less(i, j int) bool  { return h[i].dist < h[j].dist }
+func (h distHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *distHeap) Push(x interface{}) { *h = append(*h, x.(distItem)) }
+func (h *distHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func pairKey(from, to string) string {
+	return from + to
+}
+
+type pathRequest struct {
+	*lnrpc.QueryRoutesRequest
+	amtMsat      int64
+	ignoredNodes map[string]struct{}
+	ignoredPairs map[string]struct{}
+	ignoredEdges map[uint64]bool
+}
+
+func (n *Network) newPathRequest(in *lnrpc.QueryRoutesRequest, amtMsat int64) *pathRequest {
+	req := &pathRequest{
+		QueryRoutesRequest: in,
+		amtMsat:            amtMsat,
+		ignoredNodes:       map[string]struct{}{},
+		ignoredPairs:       map[string]struct{}{},
+		ignoredEdges:       map[uint64]bool{},
+	}
+	for _, node := range in.IgnoredNodes {
+		req.ignoredNodes[hex.EncodeToString(node)] = struct{}{}
+	}
+	for _, pair := range in.IgnoredPairs {
+		req.ignoredPairs[pairKey(hex.EncodeToString(pair.From), hex.EncodeToString(pair.To))] = struct{}{}
+	}
+	for _, edge := range in.IgnoredEdges {
+		req.ignoredEdges[edge.ChannelId] = edge.DirectionReverse
+	}
+	return req
+}
+
+// usable checks if the edge can carry the amount, our own channels are also
+// checked for the local balance as lnd knows it
+func (n *Network) usable(req *pathRequest, e pathEdge) bool {
+	policy := e.policy()
+	amtMsat := req.amtMsat
+	if policy == nil || policy.Disabled || e.ch.edge.Capacity*1000 < amtMsat || amtMsat < policy.MinHtlc ||
+		policy.MaxHtlcMsat > 0 && amtMsat > int64(policy.MaxHtlcMsat) {
+		return false
+	}
+	if _, ok := req.ignoredNodes[e.to]; ok {
+		return false
+	}
+	if _, ok := req.ignoredPairs[pairKey(e.from, e.to)]; ok {
+		return false
+	}
+	if reverse, ok := req.ignoredEdges[e.ch.edge.ChannelId]; ok && reverse == (e.from == e.ch.edge.Node2Pub) {
+		return false
+	}
+	if req.UseMissionControl {
+		if failedAmt, ok := n.failures[pairKey(e.from, e.to)]; ok && amtMsat >= failedAmt {
+			return false
+		}
+	}
+	if e.from == n.self {
+		if req.OutgoingChanId != 0 && e.ch.edge.ChannelId != req.OutgoingChanId {
+			return false
+		}
+		if e.ch.spendableMsat(n.self) < amtMsat {
+			return false
+		}
+	}
+	return true
+}
+
+// findPath finds the cheapest path from our node to the last hop and then to
+// the destination, the amount is approximated as constant along the path
+func (n *Network) findPath(in *lnrpc.QueryRoutesRequest, amtMsat int64) ([]pathEdge, error) {
+	req := n.newPathRequest(in, amtMsat)
+	dest := in.PubKey
+	target := dest
+	if len(in.LastHopPubkey) > 0 {
+		target = hex.EncodeToString(in.LastHopPubkey)
+	}
+	dist := map[string]int64{n.self: 0}
+	prev := map[string]pathEdge{}
+	h := &distHeap{{node: n.self}}
+	for h.Len() > 0 {
+		item := heap.Pop(h).(distItem)
+		if item.dist > dist[item.node] {
+			continue
+		}
+		if item.node == target {
+			break
+		}
+		// the destination can only be the last node of the path
+		if item.node == dest && item.node != n.self {
+			continue
+		}
+		for _, c := range n.nodeChannels[item.node] {
+			e := pathEdge{ch: c, from: item.node, to: c.peer(item.node)}
+			if e.to == n.self || !n.usable(req, e) {
+				continue
+			}
+			cost := int64(hopPenaltyMsat)
+			if e.from != n.self {
+				in := prev[e.from]
+				cost += rebalancer.ForwardFeeMsat(in.ch.policy(e.from), e.policy(), amtMsat)
+			}
+			d, ok := dist[e.to]
+			if !ok || item.dist+cost < d {
+				dist[e.to] = item.dist + cost
+				prev[e.to] = e
+				heap.Push(h, distItem{node: e.to, dist: item.dist + cost})
+			}
+		}
+	}
+	if _, ok := prev[target]; !ok {
+		return nil, fmt.Errorf("unable to find a path to destination")
+	}
+	path := []pathEdge{}
+	for node := target; node != n.self; node = prev[node].from {
+		path = append([]pathEdge{prev[node]}, path...)
+	}
+	if target == dest {
+		return path, nil
+	}
+	var last *pathEdge
+	for _, c := range n.nodeChannels[target] {
+		e := pathEdge{ch: c, from: target, to: c.peer(target)}
+		if e.to != dest || c == path[0].ch || !n.usable(req, e) {
+			continue
+		}
+		if last == nil || rebalancer.PolicyFeeMsat(e.policy(), amtMsat) < rebalancer.PolicyFeeMsat(last.policy(), amtMsat) {
+			last = &e
+		}
+	}
+	if last == nil {
+		return nil, fmt.Errorf("unable to find a path to destination")
+	}
+	return append(path, *last), nil
+}
+
+// buildRoute calculates the hop amounts, fees and expiries backwards from the
+// destination
+func (n *Network) buildRoute(path []pathEdge, amtMsat int64, finalCltv int64) *lnrpc.Route {
+	hops := make([]*lnrpc.Hop, len(path))
+	fwdMsat, feeMsat := amtMsat, int64(0)
+	expiry := int64(n.blockHeight) + finalCltv
+	route := &lnrpc.Route{}
+	for i := len(path) - 1; i >= 0; i-- {
+		e := path[i]
+		hops[i] = &lnrpc.Hop{
+			ChanId:           e.ch.edge.ChannelId,
+			ChanCapacity:     e.ch.edge.Capacity,
+			AmtToForward:     fwdMsat / 1000,
+			AmtToForwardMsat: fwdMsat,
+			Fee:              feeMsat / 1000,
+			FeeMsat:          feeMsat,
+			Expiry:           uint32(expiry),
+			PubKey:           e.to,
+		}
+		totalMsat := fwdMsat + feeMsat
+		if i == 0 {
+			route.TotalAmtMsat = totalMsat
+			break
+		}
+		// the previous hop node forwards over this channel from the channel
+		// before it
+		policy := e.policy()
+		fwdMsat = totalMsat
+		feeMsat = rebalancer.ForwardFeeMsat(path[i-1].ch.policy(e.from), policy, fwdMsat)
+		expiry += int64(policy.TimeLockDelta)
+	}
+	route.Hops = hops
+	route.TotalFeesMsat = route.TotalAmtMsat - amtMsat
+	route.TotalAmt = route.TotalAmtMsat / 1000
+	route.TotalFees = route.TotalFeesMsat / 1000
+	route.TotalTimeLock = uint32(expiry)
+	return route
+}
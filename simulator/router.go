@@ -0,0 +1,150 @@
+package simulator
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/walletrpc"
+	"github.com/rkfg/regolancer/rebalancer"
+	"google.golang.org/grpc"
+)
+
+// Router returns the lnd router client, only the methods used by regolancer
+// are implemented, the others panic
+func (n *Network) Router() routerrpc.RouterClient {
+	return &routerClient{n: n}
+}
+
+// WalletKit returns the lnd wallet client that only estimates fees
+func (n *Network) WalletKit() walletrpc.WalletKitClient {
+	return &walletClient{n: n}
+}
+
+type routerClient struct {
+	routerrpc.RouterClient
+	n *Network
+}
+
+func (r *routerClient) BuildRoute(ctx context.Context, in *routerrpc.BuildRouteRequest,
+	opts ...grpc.CallOption) (*routerrpc.BuildRouteResponse, error) {
+	n := r.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(in.HopPubkeys) == 0 {
+		return nil, fmt.Errorf("no hops specified")
+	}
+	path := []pathEdge{}
+	from := n.self
+	for i, pk := range in.HopPubkeys {
+		to := hex.EncodeToString(pk)
+		var best *pathEdge
+		for _, c := range n.nodeChannels[from] {
+			e := pathEdge{ch: c, from: from, to: c.peer(from)}
+			if e.to != to || e.policy() == nil || e.policy().Disabled {
+				continue
+			}
+			if i == 0 {
+				if in.OutgoingChanId == 0 || c.edge.ChannelId == in.OutgoingChanId {
+					best = &e
+					break
+				}
+				continue
+			}
+			if best == nil || rebalancer.PolicyFeeMsat(e.policy(), in.AmtMsat) <
+				rebalancer.PolicyFeeMsat(best.policy(), in.AmtMsat) {
+				best = &e
+			}
+		}
+		if best == nil {
+			return nil, fmt.Errorf("no matching outgoing channel available for node %d (%s)", i, to)
+		}
+		path = append(path, *best)
+		from = to
+	}
+	finalCltv := int64(in.FinalCltvDelta)
+	if finalCltv == 0 {
+		finalCltv = 40
+	}
+	return &routerrpc.BuildRouteResponse{Route: n.buildRoute(path, in.AmtMsat, finalCltv)}, nil
+}
+
+// SendToRouteV2 sends the HTLC along the route, it fails at the first hop that
+// doesn't have enough liquidity or gets an insufficient fee and settles if the
+// route ends at our node and the payment hash belongs to our invoice
+func (r *routerClient) SendToRouteV2(ctx context.Context, in *routerrpc.SendToRouteRequest,
+	opts ...grpc.CallOption) (*lnrpc.HTLCAttempt, error) {
+	n := r.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	route := in.Route
+	if route == nil || len(route.Hops) == 0 {
+		return nil, fmt.Errorf("empty route")
+	}
+	attempt := &lnrpc.HTLCAttempt{Route: route, AttemptTimeNs: time.Now().UnixNano()}
+	fail := func(code lnrpc.Failure_FailureCode, idx int) (*lnrpc.HTLCAttempt, error) {
+		attempt.Status = lnrpc.HTLCAttempt_FAILED
+		attempt.ResolveTimeNs = time.Now().UnixNano()
+		attempt.Failure = &lnrpc.Failure{Code: code, FailureSourceIndex: uint32(idx)}
+		return attempt, nil
+	}
+	edges := make([]pathEdge, len(route.Hops))
+	from := n.self
+	prevAmtMsat := int64(0)
+	for i, hop := range route.Hops {
+		amtMsat := hop.AmtToForwardMsat + hop.FeeMsat
+		c, ok := n.channels[hop.ChanId]
+		if !ok || c.side(from) < 0 || c.side(hop.PubKey) < 0 {
+			return fail(lnrpc.Failure_UNKNOWN_NEXT_PEER, i)
+		}
+		e := pathEdge{ch: c, from: from, to: hop.PubKey}
+		policy := e.policy()
+		if policy == nil || policy.Disabled {
+			return fail(lnrpc.Failure_CHANNEL_DISABLED, i)
+		}
+		if i > 0 && prevAmtMsat-amtMsat < rebalancer.ForwardFeeMsat(edges[i-1].ch.policy(from), policy, amtMsat) {
+			return fail(lnrpc.Failure_FEE_INSUFFICIENT, i)
+		}
+		if amtMsat < policy.MinHtlc {
+			return fail(lnrpc.Failure_AMOUNT_BELOW_MINIMUM, i)
+		}
+		if policy.MaxHtlcMsat > 0 && amtMsat > int64(policy.MaxHtlcMsat) || c.spendableMsat(from) < amtMsat {
+			n.failures[pairKey(e.from, e.to)] = amtMsat
+			return fail(lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE, i)
+		}
+		edges[i] = e
+		prevAmtMsat = amtMsat
+		from = hop.PubKey
+	}
+	invoice, ok := n.invoices[hex.EncodeToString(in.PaymentHash)]
+	lastHop := route.Hops[len(route.Hops)-1]
+	if from != n.self || !ok || invoice.settled || lastHop.AmtToForwardMsat < invoice.valueMsat {
+		return fail(lnrpc.Failure_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS, len(route.Hops))
+	}
+	for i, e := range edges {
+		amtMsat := route.Hops[i].AmtToForwardMsat + route.Hops[i].FeeMsat
+		e.ch.balance[e.ch.side(e.from)] -= amtMsat
+		e.ch.balance[e.ch.side(e.to)] += amtMsat
+		if failedAmt, ok := n.failures[pairKey(e.from, e.to)]; ok && failedAmt <= amtMsat {
+			delete(n.failures, pairKey(e.from, e.to))
+		}
+	}
+	invoice.settled = true
+	attempt.Status = lnrpc.HTLCAttempt_SUCCEEDED
+	attempt.ResolveTimeNs = time.Now().UnixNano()
+	attempt.Preimage = invoice.preimage
+	return attempt, nil
+}
+
+type walletClient struct {
+	walletrpc.WalletKitClient
+	n *Network
+}
+
+func (w *walletClient) EstimateFee(ctx context.Context, in *walletrpc.EstimateFeeRequest,
+	opts ...grpc.CallOption) (*walletrpc.EstimateFeeResponse, error) {
+	return &walletrpc.EstimateFeeResponse{SatPerKw: w.n.satPerKw}, nil
+}
@@ -0,0 +1,391 @@
+package simulator_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rkfg/regolancer/rebalancer"
+	"github.com/rkfg/regolancer/simulator"
+	"google.golang.org/grpc"
+)
+
+// channels of testdata/network.json, the self node has most of the liquidity
+// in the source channel (to alice) and little in the target channel (to bob).
+// The cheapest route goes through the alice-bob channel that has only 600k
+// sats on the alice side, the other route goes through carol.
+const (
+	sourceChan   = "824633720832065536"
+	targetChan   = "824633720832131072"
+	sourceChanId = 824633720832065536
+	targetChanId = 824633720832131072
+)
+
+func loadNetwork(t *testing.T) *simulator.Network {
+	n, err := simulator.Load("testdata/network.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func newRebalancer(t *testing.T, n *simulator.Network, opts rebalancer.Options) *rebalancer.Rebalancer {
+	opts.From = []string{sourceChan}
+	opts.To = []string{targetChan}
+	return newRebalancerFor(t, n, opts)
+}
+
+// newRebalancerFor creates the rebalancer with the channels selected in the
+// options
+func newRebalancerFor(t *testing.T, n *simulator.Network, opts rebalancer.Options) *rebalancer.Rebalancer {
+	if opts.FeeLimitPPM == 0 {
+		opts.FeeLimitPPM = 1000
+	}
+	opts.Seed = 1
+	r, err := rebalancer.New(context.Background(), rebalancer.Clients{
+		Lightning: n.Lightning(),
+		Router:    n.Router(),
+		WalletKit: n.WalletKit(),
+	}, opts, rebalancer.Events{Log: func(msg string) { t.Log(msg) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func localBalances(t *testing.T, n *simulator.Network) map[uint64]int64 {
+	resp, err := n.Lightning().ListChannels(context.Background(), &lnrpc.ListChannelsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[uint64]int64{}
+	for _, c := range resp.Channels {
+		result[c.ChanId] = c.LocalBalance
+	}
+	return result
+}
+
+// checkMoved verifies that the liquidity moved between the channels matches
+// the reported result
+func checkMoved(t *testing.T, before, after map[uint64]int64, result rebalancer.Result) {
+	if moved := after[targetChanId] - before[targetChanId]; moved != result.AmountSat {
+		t.Fatalf("target channel got %d sat, reported %d sat", moved, result.AmountSat)
+	}
+	// fees are paid in msat, the balance is shown in whole sats
+	spent := before[sourceChanId] - after[sourceChanId]
+	if spent < result.AmountSat+result.FeesMsat/1000 || spent > result.AmountSat+result.FeesMsat/1000+int64(result.Payments) {
+		t.Fatalf("source channel spent %d sat, reported %d sat and %d msat fee", spent, result.AmountSat, result.FeesMsat)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	n := loadNetwork(t)
+	before := localBalances(t, n)
+	r := newRebalancer(t, n, rebalancer.Options{Amount: 100_000})
+	result, err := r.Rebalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountSat != 100_000 || result.Payments != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	// bob charges 1000 msat + 50 ppm to forward to us and gives 25 ppm
+	// inbound discount for the payments from alice, alice charges 1000 msat
+	// + 100 ppm
+	if result.FeesMsat != 14_500 {
+		t.Fatalf("fee %d msat, expected 14500 msat", result.FeesMsat)
+	}
+	checkMoved(t, before, localBalances(t, n), result)
+}
+
+func TestProbeAfterFailure(t *testing.T) {
+	n := loadNetwork(t)
+	before := localBalances(t, n)
+	r := newRebalancer(t, n, rebalancer.Options{Amount: 1_000_000, ProbeSteps: 5})
+	result, err := r.Rebalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// alice can only forward 580k to bob (600k minus the reserve) and the
+	// probing finds the amount within 1M/2^5
+	if result.Payments != 1 || result.AmountSat > 580_000 || result.AmountSat < 580_000-1_000_000/32 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	checkMoved(t, before, localBalances(t, n), result)
+}
+
+func TestProbeParallelAfterFailure(t *testing.T) {
+	// parallel probing stops at the same bracket as the sequential one, within
+	// 1M/2^5 of the 580k limit after 5 steps. The sequential probing stops when
+	// the next amount is within the fail tolerance of the good or bad amount so
+	// the bracket is up to twice the tolerance.
+	tests := []struct {
+		name          string
+		steps         int
+		failTolerance int64
+		minAmount     int64
+	}{
+		{name: "steps", steps: 5, minAmount: 580_000 - 1_000_000/32},
+		{name: "fail tolerance", steps: 20, failTolerance: 100_000, minAmount: 580_000 * 8 / 10},
+	}
+	for _, tt := range tests {
+		for _, parallel := range []int{0, 4} {
+			t.Run(fmt.Sprintf("%s/parallel %d", tt.name, parallel), func(t *testing.T) {
+				n := loadNetwork(t)
+				before := localBalances(t, n)
+				r := newRebalancer(t, n, rebalancer.Options{Amount: 1_000_000, ProbeSteps: tt.steps,
+					FailTolerance: tt.failTolerance, ProbeParallel: parallel})
+				result, err := r.Rebalance(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Payments != 1 || result.AmountSat > 580_000 || result.AmountSat < tt.minAmount {
+					t.Fatalf("unexpected result %+v", result)
+				}
+				checkMoved(t, before, localBalances(t, n), result)
+			})
+		}
+	}
+}
+
+func TestRapidRebalance(t *testing.T) {
+	for _, strategy := range []string{rebalancer.RapidStrategyDouble, rebalancer.RapidStrategyStep,
+		rebalancer.RapidStrategyLadder, rebalancer.RapidStrategyRepeat} {
+		t.Run(strategy, func(t *testing.T) {
+			n := loadNetwork(t)
+			before := localBalances(t, n)
+			r := newRebalancer(t, n, rebalancer.Options{Amount: 100_000, AllowRapidRebalance: true,
+				RapidStrategy: strategy})
+			result, err := r.Rebalance(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Payments < 2 || result.AmountSat <= 100_000 {
+				t.Fatalf("rapid rebalance didn't move more: %+v", result)
+			}
+			checkMoved(t, before, localBalances(t, n), result)
+		})
+	}
+}
+
+func TestMaxRebalancesOutOfPairs(t *testing.T) {
+	// the channels run out of liquidity long before 100 rebalances, the
+	// session ends without an error as some rebalances succeeded
+	n := loadNetwork(t)
+	before := localBalances(t, n)
+	r := newRebalancer(t, n, rebalancer.Options{Amount: 200_000, MaxRebalances: 100})
+	result, err := r.Rebalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Payments < 2 || result.Payments >= 100 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	checkMoved(t, before, localBalances(t, n), result)
+}
+
+func TestGoal(t *testing.T) {
+	// refill the target channel from 10% to 40%, 200k at a time
+	n := loadNetwork(t)
+	before := localBalances(t, n)
+	r := newRebalancerFor(t, n, rebalancer.Options{Amount: 200_000, MinAmount: 10_000, Goal: targetChan + "=40%"})
+	result, err := r.Rebalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.GoalReached || result.Payments < 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	after := localBalances(t, n)
+	if after[targetChanId] > 800_000 || after[targetChanId] < 800_000-10_000 {
+		t.Fatalf("target channel has %d sat, expected 800000 sat within min amount", after[targetChanId])
+	}
+	checkMoved(t, before, after, result)
+}
+
+func TestDrain(t *testing.T) {
+	// drain the source channel from 90% down to 60% into the target channel
+	n := loadNetwork(t)
+	before := localBalances(t, n)
+	r := newRebalancerFor(t, n, rebalancer.Options{Amount: 200_000, MinAmount: 10_000, Drain: sourceChan,
+		DrainThreshold: 60, To: []string{targetChan}})
+	result, err := r.Rebalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.GoalReached || result.Payments < 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	after := localBalances(t, n)
+	// the fees are paid from the drained channel too
+	if after[sourceChanId] > 1_200_000 || after[sourceChanId] < 1_200_000-10_000-result.FeesMsat/1000 {
+		t.Fatalf("source channel has %d sat, expected 1200000 sat within min amount", after[sourceChanId])
+	}
+	checkMoved(t, before, after, result)
+}
+
+// loadNetworkWith loads the test network changing the policies of the channel
+func loadNetworkWith(t *testing.T, chanId string, update func(node1, node2 map[string]any)) *simulator.Network {
+	return editNetwork(t, func(network map[string]any) {
+		for _, e := range network["graph"].(map[string]any)["edges"].([]any) {
+			edge := e.(map[string]any)
+			if edge["channel_id"] == chanId {
+				update(edge["node1_policy"].(map[string]any), edge["node2_policy"].(map[string]any))
+			}
+		}
+	})
+}
+
+// editNetwork loads the test network after changing its JSON
+func editNetwork(t *testing.T, edit func(network map[string]any)) *simulator.Network {
+	data, err := os.ReadFile("testdata/network.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var network map[string]any
+	if err := json.Unmarshal(data, &network); err != nil {
+		t.Fatal(err)
+	}
+	edit(network)
+	data, err = json.Marshal(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "network.json")
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	n, err := simulator.Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSplitRebalance(t *testing.T) {
+	// bob only forwards 40k sat HTLCs to us
+	n := loadNetworkWith(t, targetChan, func(node1, node2 map[string]any) {
+		node2["max_htlc_msat"] = "40000000"
+	})
+	before := localBalances(t, n)
+	r := newRebalancer(t, n, rebalancer.Options{Amount: 100_000})
+	result, err := r.Rebalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountSat != 100_000 || result.Payments != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	checkMoved(t, before, localBalances(t, n), result)
+}
+
+func TestProbe(t *testing.T) {
+	n := loadNetwork(t)
+	before := localBalances(t, n)
+	r := newRebalancer(t, n, rebalancer.Options{ProbeSteps: 5})
+	result, err := r.Probe(context.Background(), []string{sourceChan, targetChan}, 1_000_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountSat > 580_000 || result.AmountSat < 580_000-1_000_000/32 || result.FeeMsat <= 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	after := localBalances(t, n)
+	if after[sourceChanId] != before[sourceChanId] || after[targetChanId] != before[targetChanId] {
+		t.Fatalf("probing moved liquidity")
+	}
+}
+
+// queryRecorder saves the route queries
+type queryRecorder struct {
+	lnrpc.LightningClient
+	queries []*lnrpc.QueryRoutesRequest
+}
+
+func (q *queryRecorder) QueryRoutes(ctx context.Context, in *lnrpc.QueryRoutesRequest,
+	opts ...grpc.CallOption) (*lnrpc.QueryRoutesResponse, error) {
+	q.queries = append(q.queries, in)
+	return q.LightningClient.QueryRoutes(ctx, in, opts...)
+}
+
+// ignored reports if the channel is ignored in the route query
+func ignored(req *lnrpc.QueryRoutesRequest, chanId uint64) bool {
+	for _, e := range req.IgnoredEdges {
+		if e.ChannelId == chanId {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTargetFirst(t *testing.T) {
+	// a third channel to carol is the cheapest source but carol has no
+	// liquidity towards bob, the payment fails and alice is used instead
+	const carolChanId = 824633720832393216
+	n := editNetwork(t, func(network map[string]any) {
+		graph := network["graph"].(map[string]any)
+		edges := graph["edges"].([]any)
+		var carolBob map[string]any
+		for _, e := range edges {
+			if edge := e.(map[string]any); edge["channel_id"] == "824633720832327680" {
+				carolBob = edge
+			}
+		}
+		carolBob["node2_policy"].(map[string]any)["fee_base_msat"] = "0"
+		carolBob["node2_policy"].(map[string]any)["fee_rate_milli_msat"] = "0"
+		graph["edges"] = append(edges, map[string]any{
+			"channel_id":   fmt.Sprint(carolChanId),
+			"chan_point":   "0000000000000000000000000000000000000000000000000000000000000006:0",
+			"last_update":  1700000000,
+			"node1_pub":    network["self"],
+			"node2_pub":    carolBob["node2_pub"],
+			"capacity":     "2000000",
+			"node1_policy": carolBob["node1_policy"],
+			"node2_policy": carolBob["node1_policy"],
+		})
+		liquidity := network["liquidity"].(map[string]any)
+		liquidity[fmt.Sprint(carolChanId)] = 1_800_000
+		liquidity["824633720832327680"] = 3_000_000
+	})
+	client := &queryRecorder{LightningClient: n.Lightning()}
+	var firstHops []uint64
+	opts := rebalancer.Options{Amount: 100_000, FeeLimitPPM: 1000, TargetFirst: true, Seed: 1,
+		From: []string{sourceChan, fmt.Sprint(carolChanId)}, To: []string{targetChan}}
+	r, err := rebalancer.New(context.Background(), rebalancer.Clients{
+		Lightning: client,
+		Router:    n.Router(),
+		WalletKit: n.WalletKit(),
+	}, opts, rebalancer.Events{
+		Log: func(msg string) { t.Log(msg) },
+		Route: func(route *lnrpc.Route, hops []rebalancer.HopInfo) {
+			firstHops = append(firstHops, route.Hops[0].ChanId)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := r.Rebalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AmountSat != 100_000 || result.Payments != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if len(firstHops) != 2 || firstHops[0] != carolChanId || firstHops[1] != sourceChanId {
+		t.Fatalf("routes started with channels %v", firstHops)
+	}
+	if len(client.queries) != 2 {
+		t.Fatalf("%d route queries, expected 2", len(client.queries))
+	}
+	first, retry := client.queries[0], client.queries[1]
+	if !ignored(first, targetChanId) || ignored(first, sourceChanId) || ignored(first, carolChanId) {
+		t.Fatalf("first query ignores wrong channels %v", first.IgnoredEdges)
+	}
+	if !ignored(retry, carolChanId) || ignored(retry, sourceChanId) {
+		t.Fatalf("failed source is not dropped before the retry %v", retry.IgnoredEdges)
+	}
+}